@@ -0,0 +1,324 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+)
+
+// the directions of the bridge mappings
+const (
+	bridgeToMQTT = "nats_to_mqtt"
+	bridgeToNATS = "mqtt_to_nats"
+)
+
+// bridgeEchoWindow is how long a forwarded message is expected to come back on the
+// other side, where it must not be forwarded again
+const bridgeEchoWindow = 5 * time.Second
+
+var bridgePlaceholder = regexp.MustCompile(`\{\{([0-9]+)\}\}`)
+
+// BridgeMapping forwards the messages of NATS subjects to MQTT topics, or the other way around.
+// The wildcards of the source (* and > for NATS, + and # for MQTT) are captured in order and
+// replace {{1}}, {{2}}... in the destination, {{id}} is the id of the device in both
+type BridgeMapping struct {
+	// Direction is nats_to_mqtt or mqtt_to_nats
+	Direction string `json:"direction"`
+	NATS      string `json:"nats"`
+	MQTT      string `json:"mqtt"`
+	QoS       byte   `json:"qos"`
+	Retain    bool   `json:"retain"`
+	// Transform is raw (the payload as is, the default) or json, wrapping the payload as
+	// {"source": ..., "time": ..., "payload": ...}
+	Transform string `json:"transform,omitempty"`
+}
+
+// bridgeRoute is a mapping ready to forward the messages
+type bridgeRoute struct {
+	BridgeMapping
+	source      string
+	destination string
+	// multi tells which captures come from a multi level wildcard
+	multi []bool
+}
+
+// bridge forwards the messages of the routes, dropping the echoes of what it forwarded
+type bridge struct {
+	routes []*bridgeRoute
+	mutex  sync.Mutex
+	echoes map[string]time.Time
+}
+
+// loadBridge reads the mappings of the bridge, as
+// [{"direction": "nats_to_mqtt", "nats": "$arduino.custom.>", "mqtt": "$aws/things/{{id}}/custom/{{1}}", "qos": 1},
+// {"direction": "mqtt_to_nats", "mqtt": "$aws/things/{{id}}/commands/+", "nats": "$arduino.commands.{{1}}", "transform": "json"}]
+func loadBridge(path, id string) (*bridge, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bridge")
+	}
+	var mappings []BridgeMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %s", path)
+	}
+	b := &bridge{echoes: map[string]time.Time{}}
+	for i, mapping := range mappings {
+		route, err := newBridgeRoute(mapping, id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mapping %d of %s", i+1, path)
+		}
+		b.routes = append(b.routes, route)
+	}
+	return b, nil
+}
+
+func newBridgeRoute(mapping BridgeMapping, id string) (*bridgeRoute, error) {
+	route := &bridgeRoute{BridgeMapping: mapping}
+	subject := strings.Replace(mapping.NATS, "{{id}}", subjectToken(id), -1)
+	topic := strings.Replace(mapping.MQTT, "{{id}}", id, -1)
+	var one, many, separator string
+	switch mapping.Direction {
+	case bridgeToMQTT:
+		route.source, route.destination = subject, topic
+		one, many, separator = "*", ">", "."
+	case bridgeToNATS:
+		route.source, route.destination = topic, subject
+		one, many, separator = "+", "#", "/"
+	default:
+		return nil, errors.Errorf("unknown direction %q", mapping.Direction)
+	}
+	if subject == "" || topic == "" {
+		return nil, errors.New("both nats and mqtt are required")
+	}
+	if mapping.QoS > 1 {
+		return nil, errors.Errorf("unsupported qos %d", mapping.QoS)
+	}
+	if mapping.Transform != "" && mapping.Transform != "raw" && mapping.Transform != "json" {
+		return nil, errors.Errorf("unknown transform %q", mapping.Transform)
+	}
+
+	tokens := strings.Split(route.source, separator)
+	for i, token := range tokens {
+		if token == many && i != len(tokens)-1 {
+			return nil, errors.Errorf("%s must be the last in %s", many, route.source)
+		}
+		if token == one || token == many {
+			route.multi = append(route.multi, token == many)
+		}
+	}
+	if bridgePlaceholder.MatchString(route.source) {
+		return nil, errors.Errorf("placeholders are not allowed in the source %s", route.source)
+	}
+
+	destinationWildcards := map[string]bool{"*": true, ">": true}
+	if mapping.Direction == bridgeToMQTT {
+		destinationWildcards = map[string]bool{"+": true, "#": true}
+	}
+	for _, token := range strings.FieldsFunc(route.destination, func(r rune) bool { return r == '.' || r == '/' }) {
+		if destinationWildcards[token] {
+			return nil, errors.Errorf("wildcards are not allowed in the destination %s", route.destination)
+		}
+	}
+	for _, match := range bridgePlaceholder.FindAllStringSubmatch(route.destination, -1) {
+		n, _ := strconv.Atoi(match[1])
+		if n < 1 || n > len(route.multi) {
+			return nil, errors.Errorf("%s has no wildcard for %s", route.source, match[0])
+		}
+	}
+	return route, nil
+}
+
+// destinationOf returns where a message received on a subject or topic is forwarded
+func (r *bridgeRoute) destinationOf(source string) string {
+	one, many, separator, destinationSeparator := "*", ">", ".", "/"
+	sanitize := strings.NewReplacer("+", "_", "#", "_").Replace
+	if r.Direction == bridgeToNATS {
+		one, many, separator, destinationSeparator = "+", "#", "/", "."
+		sanitize = func(token string) string {
+			if token == "" {
+				return "_"
+			}
+			return subjectToken(token)
+		}
+	}
+
+	var captures []string
+	tokens := strings.Split(source, separator)
+	for i, pattern := range strings.Split(r.source, separator) {
+		var captured []string
+		switch {
+		case pattern == many && i <= len(tokens):
+			captured = tokens[i:]
+		case pattern == one && i < len(tokens):
+			captured = tokens[i : i+1]
+		default:
+			continue
+		}
+		for j := range captured {
+			captured[j] = sanitize(captured[j])
+		}
+		captures = append(captures, strings.Join(captured, destinationSeparator))
+	}
+
+	return bridgePlaceholder.ReplaceAllStringFunc(r.destination, func(placeholder string) string {
+		n, _ := strconv.Atoi(bridgePlaceholder.FindStringSubmatch(placeholder)[1])
+		if n > len(captures) {
+			return ""
+		}
+		return captures[n-1]
+	})
+}
+
+// payloadOf returns the payload forwarded for a message
+func (r *bridgeRoute) payloadOf(source string, payload []byte) []byte {
+	if r.Transform != "json" {
+		return payload
+	}
+	wrapped := struct {
+		Source  string          `json:"source"`
+		Time    time.Time       `json:"time"`
+		Payload json.RawMessage `json:"payload"`
+	}{Source: source, Time: time.Now(), Payload: payload}
+	if !json.Valid(payload) {
+		wrapped.Payload, _ = json.Marshal(string(payload))
+	}
+	data, _ := json.Marshal(wrapped)
+	return data
+}
+
+// natsPermissions are the subjects the sketches need to use the bridge
+func (b *bridge) natsPermissions() (publish, subscribe []string) {
+	for _, route := range b.routes {
+		if route.Direction == bridgeToMQTT {
+			publish = append(publish, route.source)
+			continue
+		}
+		var subject []string
+		for _, token := range strings.Split(route.destination, ".") {
+			match := bridgePlaceholder.FindStringSubmatch(token)
+			if match == nil {
+				subject = append(subject, token)
+				continue
+			}
+			n, _ := strconv.Atoi(match[1])
+			if route.multi[n-1] {
+				subject = append(subject, ">")
+				break
+			}
+			subject = append(subject, "*")
+		}
+		subscribe = append(subscribe, strings.Join(subject, "."))
+	}
+	return publish, subscribe
+}
+
+func echoKey(side, destination string, payload []byte) string {
+	sum := sha1.Sum(payload)
+	return side + " " + destination + " " + string(sum[:])
+}
+
+// forwarded remembers a message sent on the other side, to recognize its echo
+func (b *bridge) forwarded(side, destination string, payload []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	for key, at := range b.echoes {
+		if now.Sub(at) > bridgeEchoWindow {
+			delete(b.echoes, key)
+		}
+	}
+	b.echoes[echoKey(side, destination, payload)] = now
+}
+
+// isEcho tells if a message was forwarded by the bridge itself, once
+func (b *bridge) isEcho(side, source string, payload []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := echoKey(side, source, payload)
+	at, ok := b.echoes[key]
+	delete(b.echoes, key)
+	return ok && time.Since(at) <= bridgeEchoWindow
+}
+
+// bridgeFromNATS forwards the messages of the nats_to_mqtt mappings, subscribed once
+func (s *Status) bridgeFromNATS(nc *nats.Conn) {
+	if s.bridge == nil {
+		return
+	}
+	for _, route := range s.bridge.routes {
+		if route.Direction != bridgeToMQTT {
+			continue
+		}
+		route := route
+		nc.Subscribe(route.source, func(m *nats.Msg) {
+			if s.mqttClient == nil || s.bridge.isEcho("nats", m.Subject, m.Data) {
+				return
+			}
+			topic := route.destinationOf(m.Subject)
+			payload := route.payloadOf(m.Subject, m.Data)
+			s.bridge.forwarded("mqtt", topic, payload)
+			token := s.mqttClient.Publish(topic, route.QoS, route.Retain, payload)
+			if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+				log.Println("Bridge to", topic, "failed:", token.Error())
+			}
+			if debugMqtt {
+				fmt.Println("MQTT OUT:", topic, string(payload))
+			}
+		})
+	}
+}
+
+// bridgeFromMQTT forwards the messages of the mqtt_to_nats mappings, subscribed on
+// every connection
+func (s *Status) bridgeFromMQTT(client mqtt.Client) {
+	if s.bridge == nil {
+		return
+	}
+	for _, route := range s.bridge.routes {
+		if route.Direction != bridgeToNATS {
+			continue
+		}
+		route := route
+		client.Subscribe(route.source, route.QoS, func(c mqtt.Client, msg mqtt.Message) {
+			if debugMqtt {
+				fmt.Println("MQTT IN:", msg.Topic(), string(msg.Payload()))
+			}
+			if s.natsClient == nil || s.bridge.isEcho("mqtt", msg.Topic(), msg.Payload()) {
+				return
+			}
+			subject := route.destinationOf(msg.Topic())
+			payload := route.payloadOf(msg.Topic(), msg.Payload())
+			s.bridge.forwarded("nats", subject, payload)
+			s.natsClient.Publish(subject, payload)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBridgeRoutes(t *testing.T) {
+	toMQTT, err := newBridgeRoute(BridgeMapping{Direction: bridgeToMQTT,
+		NATS: "$arduino.custom.*.>", MQTT: "$aws/things/{{id}}/custom/{{2}}/{{1}}"}, "dev")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "$aws/things/dev/custom/a/b/room", toMQTT.destinationOf("$arduino.custom.room.a.b"))
+	}
+
+	toNATS, err := newBridgeRoute(BridgeMapping{Direction: bridgeToNATS,
+		MQTT: "$aws/things/{{id}}/commands/+/#", NATS: "$arduino.commands.{{1}}.{{2}}", Transform: "json"}, "dev")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "$arduino.commands.fan.set.speed_max", toNATS.destinationOf("$aws/things/dev/commands/fan/set/speed.max"))
+
+		var wrapped map[string]interface{}
+		assert.NoError(t, json.Unmarshal(toNATS.payloadOf("$aws/things/dev/commands/fan", []byte(`{"on": true}`)), &wrapped))
+		assert.Equal(t, "$aws/things/dev/commands/fan", wrapped["source"])
+		assert.Equal(t, map[string]interface{}{"on": true}, wrapped["payload"])
+		assert.NoError(t, json.Unmarshal(toNATS.payloadOf("", []byte("on")), &wrapped))
+		assert.Equal(t, "on", wrapped["payload"])
+	}
+
+	b := &bridge{routes: []*bridgeRoute{toMQTT, toNATS}}
+	publish, subscribe := b.natsPermissions()
+	assert.Equal(t, []string{"$arduino.custom.*.>"}, publish)
+	assert.Equal(t, []string{"$arduino.commands.*.>"}, subscribe)
+
+	for _, mapping := range []BridgeMapping{
+		{Direction: "both", NATS: "a", MQTT: "a"},
+		{Direction: bridgeToMQTT, NATS: "a.>.b", MQTT: "a"},
+		{Direction: bridgeToMQTT, NATS: "a.*", MQTT: "a/{{2}}"},
+		{Direction: bridgeToMQTT, NATS: "a.*", MQTT: "a/#"},
+		{Direction: bridgeToNATS, MQTT: "a/+", NATS: "a.{{1}}", QoS: 2},
+		{Direction: bridgeToNATS, MQTT: "a/+", NATS: "a.{{1}}", Transform: "xml"},
+	} {
+		_, err := newBridgeRoute(mapping, "dev")
+		assert.Error(t, err, "%+v", mapping)
+	}
+}
+
+func TestBridgeEchoes(t *testing.T) {
+	b := &bridge{echoes: map[string]time.Time{}}
+	b.forwarded("mqtt", "a/b", []byte("1"))
+	assert.False(t, b.isEcho("mqtt", "a/b", []byte("2")))
+	assert.False(t, b.isEcho("nats", "a/b", []byte("1")))
+	assert.True(t, b.isEcho("mqtt", "a/b", []byte("1")))
+	assert.False(t, b.isEcho("mqtt", "a/b", []byte("1")))
+}
+
+func TestBridgeSketchPermissions(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1, NatsAuth: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	toMQTT, _ := newBridgeRoute(BridgeMapping{Direction: bridgeToMQTT, NATS: "$arduino.custom.>", MQTT: "custom/{{1}}"}, "dev")
+	toNATS, _ := newBridgeRoute(BridgeMapping{Direction: bridgeToNATS, MQTT: "commands/+", NATS: "$arduino.commands.{{1}}"}, "dev")
+	ns.allowSketches((&bridge{routes: []*bridgeRoute{toMQTT, toNATS}}).natsPermissions())
+
+	env := map[string]string{}
+	for _, variable := range ns.sketchEnv("blink") {
+		parts := strings.SplitN(variable, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	sketch, err := nats.Connect(env["NATS_URL"], nats.UserInfo(env["NATS_USER"], env["NATS_PASSWORD"]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sketch.Close()
+	connector, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer connector.Close()
+
+	// the sketch publishes on the sources of nats_to_mqtt
+	custom, _ := connector.SubscribeSync("$arduino.custom.>")
+	connector.Flush()
+	sketch.Publish("$arduino.custom.greenhouse.temp", []byte("21.5"))
+	sketch.Flush()
+	if msg, err := custom.NextMsg(time.Second); assert.NoError(t, err) {
+		assert.Equal(t, "$arduino.custom.greenhouse.temp", msg.Subject)
+	}
+
+	// and receives the destinations of mqtt_to_nats
+	commands, _ := sketch.SubscribeSync("$arduino.commands.*")
+	sketch.Flush()
+	connector.Publish("$arduino.commands.fan", []byte("on"))
+	connector.Flush()
+	if msg, err := commands.NextMsg(time.Second); assert.NoError(t, err) {
+		assert.Equal(t, "on", string(msg.Data))
+	}
+}
@@ -0,0 +1,321 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultDylibRegistry = "https://downloads.arduino.cc/libArduino/dylib_dependencies.txt"
+
+// dylibFile is a shared library provided by a registry entry
+type dylibFile struct {
+	Name   string `json:"Name"`
+	Soname string `json:"Soname"`
+	Sha256 string `json:"Sha256"`
+}
+
+// dylibMap is an entry of the dylib registry. Provides is the legacy list of
+// file names without checksums: it's installed only when Files is empty and
+// dylib_allow_legacy is set.
+type dylibMap struct {
+	Name     string      `json:"Name"`
+	Version  string      `json:"Version"`
+	Arch     string      `json:"Arch"`
+	Provides []string    `json:"Provides"`
+	Files    []dylibFile `json:"Files"`
+	URL      string      `json:"URL"`
+	Help     string      `json:"Help"`
+}
+
+// Contains tells if the entry provides the library
+func (d *dylibMap) Contains(match string) bool {
+	for _, file := range d.Files {
+		if file.Name == match || file.Soname == match {
+			return true
+		}
+	}
+	for _, element := range d.Provides {
+		if strings.Contains(element, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// plainFileName tells if name is a file name, without any folder
+func plainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsRune(name, filepath.Separator) && filepath.Base(name) == name
+}
+
+// validate checks that the entry only installs files in the lib folder, each with a checksum
+func (d *dylibMap) validate() error {
+	for _, file := range d.Files {
+		if !plainFileName(file.Name) {
+			return errors.Errorf("%s: invalid file name %q", d.Name, file.Name)
+		}
+		if file.Soname != "" && !plainFileName(file.Soname) {
+			return errors.Errorf("%s: invalid soname %q", d.Name, file.Soname)
+		}
+		if sum, err := hex.DecodeString(file.Sha256); err != nil || len(sum) != sha256.Size {
+			return errors.Errorf("%s: %s doesn't have a valid sha256, refusing to install it", d.Name, file.Name)
+		}
+	}
+	for _, element := range d.Provides {
+		if !plainFileName(element) {
+			return errors.Errorf("%s: invalid file name %q", d.Name, element)
+		}
+	}
+	return nil
+}
+
+// Download installs all the files of the entry in path, verifying their checksum.
+// Verified files are kept in cacheFolder and not downloaded again. The checksums
+// come from the registry itself: they catch corrupted downloads, not a tampered registry.
+func (d *dylibMap) Download(path, cacheFolder string, allowLegacy bool) error {
+	if err := d.validate(); err != nil {
+		return err
+	}
+	if len(d.Files) == 0 {
+		if !allowLegacy || len(d.Provides) == 0 {
+			return errors.New(d.Name + " doesn't provide checksums, refusing to install it")
+		}
+		return d.downloadLegacy(path)
+	}
+	for _, file := range d.Files {
+		cached := filepath.Join(cacheFolder, strings.ToLower(file.Sha256))
+		if sum, err := fileSHA256(cached); err != nil || !strings.EqualFold(sum, file.Sha256) {
+			if err := fetchDylib(d.URL+"/"+file.Name, cached, file.Sha256); err != nil {
+				return errors.Wrapf(err, "download %s", file.Name)
+			}
+		}
+		if err := installDylib(cached, filepath.Join(path, file.Name)); err != nil {
+			return errors.Wrapf(err, "install %s", file.Name)
+		}
+		if file.Soname != "" && file.Soname != file.Name {
+			// the loader looks for the soname
+			link := filepath.Join(path, file.Soname)
+			os.Remove(link)
+			os.Symlink(file.Name, link)
+		}
+	}
+	return nil
+}
+
+// downloadLegacy installs the Provides files of the entry as they are, without any checksum
+func (d *dylibMap) downloadLegacy(path string) error {
+	fmt.Println("WARNING: " + d.Name + " doesn't provide checksums, installing it unverified")
+	for _, element := range d.Provides {
+		tmp := filepath.Join(path, element+".tmp")
+		if err := fetchDylib(d.URL+"/"+element, tmp, ""); err != nil {
+			return errors.Wrapf(err, "download %s", element)
+		}
+		if err := os.Rename(tmp, filepath.Join(path, element)); err != nil {
+			return errors.Wrapf(err, "install %s", element)
+		}
+	}
+	return nil
+}
+
+// fetchDylib downloads a library from a remote or local location and verifies it, unless sha
+// is empty, before putting it in the cache
+func fetchDylib(location, cached, sha string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(cached), "download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	body, err := openRegistryLocation(location)
+	if err == nil {
+		_, err = io.Copy(tmp, body)
+		body.Close()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if sha != "" {
+		sum, err := fileSHA256(tmp.Name())
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, sha) {
+			return errors.Errorf("sha256 mismatch: expected %s, got %s", sha, sum)
+		}
+	}
+	return os.Rename(tmp.Name(), cached)
+}
+
+// installDylib copies a cached library into the lib folder
+func installDylib(cached, dest string) error {
+	data, err := ioutil.ReadFile(cached)
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// openRegistryLocation opens a http(s) URL, a file:// URL or a local path
+func openRegistryLocation(location string) (io.ReadCloser, error) {
+	u, err := url.Parse(location)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		client := http.Client{Timeout: 5 * time.Minute}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, errors.New("Expected OK, got " + resp.Status)
+		}
+		return resp.Body, nil
+	}
+	if err == nil && u.Scheme == "file" {
+		location = u.Path
+	}
+	return os.Open(location)
+}
+
+// dylibRegistries returns the configured registries, in order of priority
+func dylibRegistries(config Config) []string {
+	var registries []string
+	for _, registry := range strings.Split(config.DylibRegistries, ",") {
+		if registry = strings.TrimSpace(registry); registry != "" {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+// loadDylibRegistry reads a registry, the last good copy is cached
+// and used when the registry is unreachable
+func loadDylibRegistry(registry, cacheFolder string) ([]dylibMap, error) {
+	hash := sha256.Sum256([]byte(registry))
+	cached := filepath.Join(cacheFolder, "registry-"+hex.EncodeToString(hash[:8])+".json")
+
+	var entries []dylibMap
+	body, err := openRegistryLocation(registry)
+	if err == nil {
+		var data []byte
+		data, err = ioutil.ReadAll(body)
+		body.Close()
+		if err == nil {
+			err = json.Unmarshal(data, &entries)
+		}
+		if err == nil {
+			ioutil.WriteFile(cached, data, 0600)
+			return entries, nil
+		}
+	}
+
+	data, cacheErr := ioutil.ReadFile(cached)
+	if cacheErr != nil {
+		return nil, errors.Wrapf(err, "read dylib registry %s", registry)
+	}
+	fmt.Println("Using cached copy of dylib registry " + registry + ": " + err.Error())
+	entries = nil
+	return entries, json.Unmarshal(data, &entries)
+}
+
+// downloadDylibDependencies looks for library in the configured registries and installs
+// the first entry providing it for this architecture in the sketch lib folder
+func downloadDylibDependencies(library string, config Config) error {
+	folder, err := getSketchFolder()
+	if err != nil {
+		return err
+	}
+	libFolder := filepath.Join(folder, "lib")
+	os.MkdirAll(libFolder, 0700)
+	cacheFolder, err := getSketchSubFolder("dylib-cache")
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, registry := range dylibRegistries(config) {
+		entries, err := loadDylibRegistry(registry, cacheFolder)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, element := range entries {
+			if !element.Contains(library) || (element.Arch != "" && element.Arch != runtime.GOARCH) {
+				continue
+			}
+			if element.Help != "" {
+				return errors.New(element.Help)
+			}
+			// a registry may refer to libraries relative to itself
+			if element.URL == "" {
+				element.URL = registryBase(registry)
+			}
+			fmt.Println("Installing " + element.Name + " " + element.Version + " from " + registry)
+			return element.Download(libFolder, cacheFolder, config.DylibAllowLegacy)
+		}
+	}
+	errs = append(errs, "Can't find a provider for "+library)
+	return errors.New(strings.Join(errs, "; "))
+}
+
+func registryBase(registry string) string {
+	if i := strings.LastIndex(registry, "/"); i >= 0 {
+		return registry[:i]
+	}
+	return "."
+}
+
+// preseedDylibs installs the given libraries ahead of any sketch needing them
+func preseedDylibs(libraries []string, config Config) error {
+	failed := 0
+	for _, library := range libraries {
+		if library = strings.TrimSpace(library); library == "" {
+			continue
+		}
+		if err := downloadDylibDependencies(library, config); err != nil {
+			fmt.Println("Failed to install " + library + ": " + err.Error())
+			failed++
+			continue
+		}
+		fmt.Println("Installed " + library)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d libraries not installed", failed)
+	}
+	return nil
+}
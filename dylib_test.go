@@ -0,0 +1,107 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDylibEntryValidation(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	tests := []struct {
+		name  string
+		entry dylibMap
+		err   string
+	}{
+		{"files", dylibMap{Files: []dylibFile{{Name: "libfoo.so.1.2", Soname: "libfoo.so.1", Sha256: sha}}}, ""},
+		{"legacy", dylibMap{Provides: []string{"libfoo.so.1"}}, ""},
+		{"parent folder", dylibMap{Files: []dylibFile{{Name: "../libfoo.so", Sha256: sha}}}, "invalid file name"},
+		{"absolute", dylibMap{Files: []dylibFile{{Name: "/etc/passwd", Sha256: sha}}}, "invalid file name"},
+		{"subfolder", dylibMap{Files: []dylibFile{{Name: "sub/libfoo.so", Sha256: sha}}}, "invalid file name"},
+		{"empty", dylibMap{Files: []dylibFile{{Name: "", Sha256: sha}}}, "invalid file name"},
+		{"dot", dylibMap{Files: []dylibFile{{Name: ".", Sha256: sha}}}, "invalid file name"},
+		{"dot dot", dylibMap{Files: []dylibFile{{Name: "..", Sha256: sha}}}, "invalid file name"},
+		{"soname outside", dylibMap{Files: []dylibFile{{Name: "libfoo.so", Soname: "../../libc.so.6", Sha256: sha}}}, "invalid soname"},
+		{"soname dot dot", dylibMap{Files: []dylibFile{{Name: "libfoo.so", Soname: "..", Sha256: sha}}}, "invalid soname"},
+		{"missing sha256", dylibMap{Files: []dylibFile{{Name: "libfoo.so"}}}, "valid sha256"},
+		{"sha256 as a path", dylibMap{Files: []dylibFile{{Name: "libfoo.so", Sha256: "../" + sha[3:]}}}, "valid sha256"},
+		{"short sha256", dylibMap{Files: []dylibFile{{Name: "libfoo.so", Sha256: "abcd"}}}, "valid sha256"},
+		{"legacy outside", dylibMap{Provides: []string{"../../bin/sh"}}, "invalid file name"},
+	}
+	for _, test := range tests {
+		err := test.entry.validate()
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+}
+
+func TestDylibDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dylib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mirror, lib, cache := filepath.Join(dir, "mirror"), filepath.Join(dir, "lib"), filepath.Join(dir, "cache")
+	for _, folder := range []string{mirror, lib, cache} {
+		os.Mkdir(folder, 0700)
+	}
+	content := []byte("library")
+	ioutil.WriteFile(filepath.Join(mirror, "libfoo.so.1.2"), content, 0600)
+	sum := sha256.Sum256(content)
+	sha := hex.EncodeToString(sum[:])
+
+	entry := dylibMap{Name: "libfoo", URL: mirror, Files: []dylibFile{{Name: "libfoo.so.1.2", Soname: "libfoo.so.1", Sha256: sha}}}
+	if assert.NoError(t, entry.Download(lib, cache, false)) {
+		data, _ := ioutil.ReadFile(filepath.Join(lib, "libfoo.so.1"))
+		assert.Equal(t, content, data)
+		target, _ := os.Readlink(filepath.Join(lib, "libfoo.so.1"))
+		assert.Equal(t, "libfoo.so.1.2", target)
+	}
+
+	// a checksum mismatch isn't installed nor cached
+	wrong := dylibMap{Name: "libbar", URL: mirror, Files: []dylibFile{{Name: "libfoo.so.1.2", Sha256: strings.Repeat("0", 64)}}}
+	err = wrong.Download(filepath.Join(dir, "other"), cache, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sha256 mismatch")
+	}
+	_, err = os.Stat(filepath.Join(cache, strings.Repeat("0", 64)))
+	assert.True(t, os.IsNotExist(err))
+
+	// the legacy entries only when allowed
+	legacy := dylibMap{Name: "libfoo", URL: mirror, Provides: []string{"libfoo.so.1.2"}}
+	assert.Error(t, legacy.Download(lib, cache, false))
+	assert.NoError(t, legacy.Download(lib, cache, true))
+
+	// nothing is written outside of the lib folder
+	escaping := dylibMap{Name: "libfoo", URL: mirror, Files: []dylibFile{{Name: "libfoo.so.1.2", Soname: "../escaped", Sha256: sha}}}
+	assert.Error(t, escaping.Download(lib, cache, false))
+	_, err = os.Lstat(filepath.Join(dir, "escaped"))
+	assert.True(t, os.IsNotExist(err))
+}
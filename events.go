@@ -0,0 +1,142 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"golang.org/x/net/context"
+)
+
+const (
+	// eventsSubject is the prefix of the subjects of the events, followed by their kind
+	eventsSubject = "$arduino.events."
+	// networkPollInterval is how often the network interfaces are checked for changes
+	networkPollInterval = 5 * time.Second
+)
+
+// containerLifecycle are the docker actions published as container events
+var containerLifecycle = map[string]bool{
+	"create": true, "start": true, "restart": true, "pause": true, "unpause": true,
+	"kill": true, "stop": true, "die": true, "oom": true, "destroy": true,
+}
+
+// Event is something that happened in the connector, published on $arduino.events.<kind>
+type Event struct {
+	Kind string      `json:"kind"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Event publishes an event for the apps and sketches on the device
+func (s *Status) Event(kind string, data interface{}) {
+	if s == nil || s.natsClient == nil {
+		return
+	}
+	payload, err := json.Marshal(Event{Kind: kind, Time: time.Now(), Data: data})
+	if err != nil {
+		return
+	}
+	s.natsClient.Publish(eventsSubject+kind, payload)
+}
+
+// NetworkInterface is an interface in a network.changed event
+type NetworkInterface struct {
+	Name      string   `json:"name"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+func networkInterfaces() []NetworkInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var list []NetworkInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		item := NetworkInterface{Name: iface.Name, Up: iface.Flags&net.FlagUp != 0, Addresses: []string{}}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			item.Addresses = append(item.Addresses, addr.String())
+		}
+		sort.Strings(item.Addresses)
+		list = append(list, item)
+	}
+	return list
+}
+
+// watchNetwork publishes network.changed when an interface appears, goes up or down
+// or changes its addresses
+func (s *Status) watchNetwork() {
+	previous := networkInterfaces()
+	for range time.Tick(networkPollInterval) {
+		current := networkInterfaces()
+		if !reflect.DeepEqual(previous, current) {
+			s.Event("network.changed", map[string]interface{}{"interfaces": current})
+		}
+		previous = current
+	}
+}
+
+// watchContainers publishes the lifecycle of the containers as container.<action>
+func (s *Status) watchContainers() {
+	if s.dockerClient == nil {
+		return
+	}
+	for {
+		options := types.EventsOptions{Filters: filters.NewArgs(filters.Arg("type", "container"))}
+		messages, errs := s.dockerClient.Events(context.Background(), options)
+	loop:
+		for {
+			select {
+			case message := <-messages:
+				action := strings.SplitN(message.Action, ":", 2)[0]
+				if !containerLifecycle[action] {
+					continue
+				}
+				data := map[string]string{
+					"id":    message.Actor.ID,
+					"name":  message.Actor.Attributes["name"],
+					"image": message.Actor.Attributes["image"],
+				}
+				if sketch := message.Actor.Attributes["cc.arduino.sketch"]; sketch != "" {
+					data["sketch"] = sketch
+				}
+				if exitCode, ok := message.Actor.Attributes["exitCode"]; ok {
+					data["exit_code"] = exitCode
+				}
+				s.Event("container."+action, data)
+			case <-errs:
+				break loop
+			}
+		}
+		// the docker daemon restarted, or isn't running
+		time.Sleep(10 * time.Second)
+	}
+}
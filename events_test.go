@@ -0,0 +1,66 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchStateEvents(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	nc, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+
+	status := NewStatus("dev", nil, nil)
+	status.natsClient = nc
+	events, _ := nc.SubscribeSync("$arduino.events.sketch.>")
+	nc.Flush()
+
+	sketch := &SketchStatus{ID: "blink", Name: "blink", Status: SketchRunning}
+	assert.NoError(t, status.setSketchState(sketch, SketchCrashed, "exit status 1"))
+
+	msg, err := events.NextMsg(time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "$arduino.events.sketch.crashed", msg.Subject)
+	var event struct {
+		Kind string            `json:"kind"`
+		Data SketchStateChange `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(msg.Data, &event))
+	assert.Equal(t, "sketch.crashed", event.Kind)
+	assert.Equal(t, SketchRunning, event.Data.From)
+	assert.Equal(t, "exit status 1", event.Data.Reason)
+
+	// nothing to publish on without NATS
+	var nothing *Status
+	nothing.Event("mqtt.connected", nil)
+}
@@ -19,34 +19,113 @@
 package main
 
 import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// DylibFile is a library provided by a registry entry
+type DylibFile struct {
+	Name   string
+	Soname string
+	Sha256 string
+}
+
+// DylibMap is an entry of the dylib registry read by arduino-connector
 type DylibMap struct {
 	Name     string
+	Version  string
+	Arch     string
 	Provides []string
+	Files    []DylibFile
 	URL      string
 	Help     string
 }
 
+// goArch maps ELF machines to the GOARCH values used by the connector
+var goArch = map[elf.Machine]string{
+	elf.EM_386:     "386",
+	elf.EM_X86_64:  "amd64",
+	elf.EM_ARM:     "arm",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_MIPS:    "mips",
+	elf.EM_PPC64:   "ppc64le",
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readLibrary returns the soname and the architecture found in the ELF headers
+func readLibrary(path string) (string, string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	soname := filepath.Base(path)
+	if names, err := f.DynString(elf.DT_SONAME); err == nil && len(names) > 0 {
+		soname = names[0]
+	}
+	return soname, goArch[f.Machine], nil
+}
+
+// Usage: main [-url base] [-version v] [-help text] folder...
+// prints the registry entries for the libraries found in each folder
 func main() {
+	url := flag.String("url", "", "Base URL the libraries are served from (empty means relative to the registry)")
+	version := flag.String("version", "", "Version of the libraries")
+	help := flag.String("help", "", "Help message shown instead of installing the libraries, %s is replaced by the folder name")
+	flag.Parse()
+
 	var v []DylibMap
 
-	for _, arg := range os.Args[1:] {
+	for _, arg := range flag.Args() {
 		var lib DylibMap
 		lib.Name = filepath.Base(arg)
+		lib.Version = *version
+		lib.URL = *url
 
 		filepath.Walk(arg, func(path string, f os.FileInfo, err error) error {
-			if strings.Contains(f.Name(), ".so") {
-				lib.Provides = append(lib.Provides, f.Name())
+			if err != nil || !f.Mode().IsRegular() || !strings.Contains(f.Name(), ".so") {
+				return nil
+			}
+			soname, arch, err := readLibrary(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "skipping "+path+": "+err.Error())
+				return nil
+			}
+			sum, err := hashFile(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "skipping "+path+": "+err.Error())
+				return nil
+			}
+			if lib.Arch == "" {
+				lib.Arch = arch
 			}
+			lib.Provides = append(lib.Provides, f.Name())
+			lib.Files = append(lib.Files, DylibFile{Name: f.Name(), Soname: soname, Sha256: sum})
 			return nil
 		})
-		lib.Help = "Please install " + lib.Name + " library from Intel website http://intel.com/"
+		if *help != "" {
+			lib.Help = strings.Replace(*help, "%s", lib.Name, -1)
+		}
 		v = append(v, lib)
 	}
 	bytes, err := json.Marshal(v)
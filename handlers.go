@@ -30,14 +30,12 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/kardianos/osext"
 	"github.com/kr/pty"
-	nats "github.com/nats-io/go-nats"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -60,24 +58,25 @@ func (status *Status) UpdateEvent(client mqtt.Client, msg mqtt.Message) {
 		status.Error("/update", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
 		return
 	}
+	status.Event("update.started", map[string]string{"url": info.URL})
 	executablePath, _ := os.Executable()
 	name := filepath.Join(os.TempDir(), filepath.Base(executablePath))
 	err = downloadFile(name, info.URL, info.Token)
 	err = downloadFile(name+".sig", info.URL+".sig", info.Token)
 	if err != nil {
-		status.Error("/update", errors.Wrap(err, "no signature file "+info.URL+".sig"))
+		status.updateFailed(info.URL, errors.Wrap(err, "no signature file "+info.URL+".sig"))
 		return
 	}
 	// check the signature
 	err = checkGPGSig(name, name+".sig")
 	if err != nil {
-		status.Error("/update", errors.Wrap(err, "wrong signature "+info.URL+".sig"))
+		status.updateFailed(info.URL, errors.Wrap(err, "wrong signature "+info.URL+".sig"))
 		return
 	}
 	// chmod it
 	err = os.Chmod(name, 0755)
 	if err != nil {
-		status.Error("/update", errors.Wrapf(err, "chmod 755 %s", name))
+		status.updateFailed(info.URL, errors.Wrapf(err, "chmod 755 %s", name))
 		return
 	}
 	os.Rename(executablePath, executablePath+".old")
@@ -86,25 +85,40 @@ func (status *Status) UpdateEvent(client mqtt.Client, msg mqtt.Message) {
 	if err != nil {
 		// rollback
 		os.Rename(executablePath+".old", executablePath)
-		status.Error("/update", errors.Wrap(err, "error copying itself from "+name+" to "+executablePath))
+		status.updateFailed(info.URL, errors.Wrap(err, "error copying itself from "+name+" to "+executablePath))
 		return
 	}
 	os.Chmod(executablePath, 0755)
 	os.Remove(executablePath + ".old")
+	status.Event("update.installed", map[string]string{"url": info.URL})
+	if status.natsClient != nil {
+		status.natsClient.FlushTimeout(time.Second)
+	}
 	// leap of faith: kill itself, systemd should respawn the process
 	os.Exit(0)
 }
 
+// updateFailed reports an update that couldn't be installed
+func (status *Status) updateFailed(url string, err error) {
+	status.Error("/update", err)
+	status.Event("update.failed", map[string]string{"url": url, "error": err.Error()})
+}
+
 // UploadEvent receives the url and name of the sketch binary, then it
-// - downloads the binary,
-// - chmods +x it
+// - downloads the binary in a temporary location,
+// - verifies its sha256 and signature, if provided or required
+// - moves it into the sketch folder and chmods +x it
 // - executes redirecting stdout and sterr to a proper logger
 func (status *Status) UploadEvent(client mqtt.Client, msg mqtt.Message) {
 	var info struct {
-		ID    string `json:"id"`
-		URL   string `json:"url"`
-		Name  string `json:"name"`
-		Token string `json:"token"`
+		ID        string `json:"id"`
+		URL       string `json:"url"`
+		Name      string `json:"name"`
+		Token     string `json:"token"`
+		SHA256    string `json:"sha256"`
+		Signature string `json:"signature"`
+		// Container runs the sketch in a container, an empty image runs it on the host
+		Container *SketchContainer `json:"container"`
 	}
 	err := json.Unmarshal(msg.Payload(), &info)
 	if err != nil {
@@ -116,76 +130,236 @@ func (status *Status) UploadEvent(client mqtt.Client, msg mqtt.Message) {
 		info.ID = info.Name
 	}
 
-	// Stop and delete if existing
-	var sketch SketchStatus
-	if sketch, ok := status.Sketches[info.ID]; ok {
-		err = applyAction(sketch, "STOP", status)
+	// download the binary outside of the sketch folder
+	tmpFile, err := ioutil.TempFile("", "sketch-")
+	if err != nil {
+		status.Error("/upload", errors.Wrap(err, "create temporary file"))
+		return
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	err = downloadFile(tmpFile.Name(), info.URL, info.Token)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "download file %s", info.URL))
+		return
+	}
+
+	err = verifySketch(tmpFile.Name(), info.SHA256, info.Signature, status.config)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "verify sketch %s", info.Name))
+		return
+	}
+
+	if info.Container != nil {
+		err = saveSketchContainer(info.ID, info.Container)
 		if err != nil {
-			status.Error("/upload", errors.Wrapf(err, "stop pid %d", sketch.PID))
+			status.Error("/upload", errors.Wrapf(err, "save container settings of %s", info.ID))
 			return
 		}
+	}
 
-		sketchFolder, err := getSketchFolder()
-		sketchPath := filepath.Join(sketchFolder, sketch.Name)
+	status.installSketch(info.ID, info.Name, info.URL, tmpFile.Name())
+}
 
-		if _, err = os.Stat(sketchPath); !os.IsNotExist(err) {
-			err = os.Remove(sketchPath)
-			if err != nil {
-				status.Error("/upload", errors.Wrapf(err, "remove %d", sketch.Name))
-				return
-			}
-		}
+// installSketch replaces the sketch identified by id with the verified binary
+// found at path, downloaded from url, records it in the sketch history and
+// starts it. The new binary is staged beside the old one and swapped in
+// atomically, the old one is kept until the new one survives the probation
+// window, otherwise it's restored and restarted.
+func (status *Status) installSketch(id, name, url, path string) {
+	name = filepath.Base(name)
+	if err := checkSketchName(name); err != nil {
+		status.Error("/upload", errors.Wrapf(err, "install sketch %s", id))
+		return
 	}
 
 	folder, err := getSketchFolder()
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "create sketch folder %s", info.ID))
+		status.Error("/upload", errors.Wrapf(err, "create sketch folder %s", id))
+		return
+	}
+	stagingFolder, err := getSketchSubFolder("staging")
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "create staging folder %s", id))
+		return
+	}
+	previousFolder, err := getSketchSubFolder("previous")
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "create previous folder %s", id))
 		return
 	}
 
-	// download the binary
-	name := filepath.Join(folder, info.Name)
-	err = downloadFile(name, info.URL, info.Token)
+	version, err := fileSHA256(path)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "download file %s", info.URL))
+		status.Error("/upload", errors.Wrapf(err, "hash %s", path))
 		return
 	}
 
+	// stage the binary on the same filesystem of the sketch folder
+	staged := filepath.Join(stagingFolder, name)
+	err = os.Rename(path, staged)
+	if err != nil {
+		// the temporary folder may be on another filesystem
+		err = copyFileAndRemoveOriginal(path, staged)
+		if err != nil {
+			status.Error("/upload", errors.Wrapf(err, "move %s to %s", path, staged))
+			return
+		}
+	}
+	defer os.Remove(staged)
+
 	// chmod it
-	err = os.Chmod(name, 0700)
+	err = os.Chmod(staged, 0700)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "chmod 700 %s", name))
+		status.Error("/upload", errors.Wrapf(err, "chmod 700 %s", staged))
 		return
 	}
 
-	sketch.ID = info.ID
-	sketch.Name = info.Name
+	// make sure the sketch can run before stopping the current one
+	err = status.preflightSketch(id, staged)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "check sketch %s", name))
+		return
+	}
+
+	err = archiveSketchVersion(id, name, url, staged, version, status.config)
+	if err != nil {
+		// the history is a convenience, don't prevent the upload
+		status.Error("/upload", errors.Wrapf(err, "archive version %s of %s", version, id))
+	}
+
+	// Stop the existing sketch and put its binary aside
+	var previous *sketchProbation
+	if existing, ok := status.Sketches[id]; ok {
+		err = status.stopSketchIfActive(existing)
+		if err != nil {
+			status.Error("/upload", errors.Wrapf(err, "stop pid %d", existing.PID))
+			return
+		}
+
+		sketchPath := filepath.Join(folder, existing.Name)
+		backup := filepath.Join(previousFolder, existing.Name)
+		if _, err = os.Stat(sketchPath); err == nil {
+			err = os.Rename(sketchPath, backup)
+			if err != nil {
+				status.Error("/upload", errors.Wrapf(err, "backup %s", existing.Name))
+				return
+			}
+			previous = &sketchProbation{name: existing.Name, path: backup}
+		}
+	}
+
+	filename := filepath.Join(folder, name)
+	err = os.Rename(staged, filename)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "move %s to %s", staged, filename))
+		if previous != nil {
+			os.Rename(previous.path, filepath.Join(folder, previous.name))
+		}
+		return
+	}
+
+	sketch := SketchStatus{ID: id, Name: name, Status: SketchStopped}
+	if previous != nil && status.config.SketchProbation > 0 {
+		previous.version = version
+		previous.deadline = time.Now().Add(status.config.SketchProbation)
+		sketch.probation = previous
+	} else {
+		// nothing to go back to, the new version is there for good
+		markActiveSketchVersion(id, version)
+	}
 	// save ID-Name to a sort of DB
 	insertSketchInDB(sketch.Name, sketch.ID)
 
 	// spawn process
-	pid, _, _, err := spawnProcess(name, &sketch, status)
+	err = status.startSketch(&sketch)
 	if err != nil {
-		status.Error("/upload", errors.Wrapf(err, "spawn %s", name))
+		status.Error("/upload", errors.Wrapf(err, "spawn %s", filename))
+		if sketch.probation != nil {
+			status.rollbackSketch(&sketch)
+		}
 		return
 	}
 
-	status.Info("/upload", "Sketch started with PID "+strconv.Itoa(pid))
+	status.Info("/upload", "Sketch started with PID "+strconv.Itoa(sketch.PID))
 
-	sketch.PID = pid
-	sketch.Status = "RUNNING"
+	if probation := sketch.probation; probation != nil {
+		time.AfterFunc(status.config.SketchProbation, func() {
+			sketch.mutex.Lock()
+			// an exit during the window is left to sketchExited
+			if sketch.probation == probation && sketch.process != nil {
+				sketch.endProbation()
+			}
+			sketch.mutex.Unlock()
+		})
+	} else if previous != nil {
+		os.Remove(previous.path)
+	}
 
-	status.Set(info.ID, &sketch)
+	status.Set(id, &sketch)
 	status.Publish()
+}
 
-	// go func(stdout io.ReadCloser) {
-	// 	in := bufio.NewScanner(stdout)
-	// 	for {
-	// 		for in.Scan() {
-	// 			fmt.Printf(in.Text()) // write each line to your log, or anything you need
-	// 		}
-	// 	}
-	// }(stdout)
+// sketchProbation keeps track of the binary replaced by an upload,
+// until the new version proves to be running
+type sketchProbation struct {
+	name     string
+	path     string
+	version  string
+	deadline time.Time
+}
+
+// endProbation keeps the new version for good and removes the binary it replaced,
+// it's called with the mutex of the sketch held
+func (sketch *SketchStatus) endProbation() {
+	if sketch.probation != nil {
+		os.Remove(sketch.probation.path)
+		markActiveSketchVersion(sketch.ID, sketch.probation.version)
+		sketch.probation = nil
+	}
+}
+
+// failedProbation tells if the sketch exited on its own before the end of its probation window
+func (sketch *SketchStatus) failedProbation() bool {
+	return sketch.probation != nil && time.Now().Before(sketch.probation.deadline)
+}
+
+// rollbackSketch restores and restarts the binary replaced by the last upload
+func (status *Status) rollbackSketch(sketch *SketchStatus) {
+	probation := sketch.probation
+	sketch.probation = nil
+
+	folder, err := getSketchFolder()
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "rollback %s", sketch.ID))
+		return
+	}
+	if probation.name != sketch.Name {
+		os.Remove(filepath.Join(folder, sketch.Name))
+	}
+	filename := filepath.Join(folder, probation.name)
+	err = os.Rename(probation.path, filename)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "rollback %s", sketch.ID))
+		return
+	}
+
+	status.Error("/upload", errors.Errorf("sketch %s version %s failed, rolling back to the previous version", sketch.ID, probation.version))
+
+	sketch.Name = probation.name
+	sketch.FailedVersion = probation.version
+	insertSketchInDB(sketch.Name, sketch.ID)
+	if sha, err := fileSHA256(filename); err == nil {
+		markActiveSketchVersion(sketch.ID, sha)
+	}
+
+	err = status.startSketch(sketch)
+	if err != nil {
+		status.Error("/upload", errors.Wrapf(err, "spawn %s", filename))
+	}
+	status.Set(sketch.ID, sketch)
+	status.Publish()
 }
 
 func getSketchFolder() (string, error) {
@@ -198,16 +372,43 @@ func getSketchFolder() (string, error) {
 	return folder, err
 }
 
-func getSketchDBFolder() (string, error) {
+func getSketchSubFolder(name string) (string, error) {
 	// create folder if it doesn't exist
 	folder, err := getSketchFolder()
-	folder = filepath.Join(folder, "db")
+	folder = filepath.Join(folder, name)
 	if _, err := os.Stat(folder); os.IsNotExist(err) {
 		err = os.Mkdir(folder, 0700)
 	}
 	return folder, err
 }
 
+// reservedSketchNames are the folders the connector keeps beside the sketches
+var reservedSketchNames = map[string]bool{
+	"staging":     true,
+	"previous":    true,
+	"versions":    true,
+	"db":          true,
+	"lib":         true,
+	"bundles":     true,
+	"dylib-cache": true,
+}
+
+// checkSketchName refuses the names that can't be a file of the sketch folder,
+// or would replace one of the folders of the connector
+func checkSketchName(name string) error {
+	if !plainFileName(name) {
+		return errors.Errorf("invalid sketch name %q", name)
+	}
+	if reservedSketchNames[name] {
+		return errors.Errorf("%q is a reserved name, it can't be used for a sketch", name)
+	}
+	return nil
+}
+
+func getSketchDBFolder() (string, error) {
+	return getSketchSubFolder("db")
+}
+
 func getSketchDB() (string, error) {
 	// create folder if it doesn't exist
 	folder, err := getSketchDBFolder()
@@ -257,59 +458,103 @@ func getSketchIDFromDB(name string) (string, error) {
 	return "", errors.New("No matching sketch")
 }
 
+// loadSketchSettings reads the settings of kind (eg. display) of every sketch, stored next to the DB
+func loadSketchSettings(kind string, into interface{}) error {
+	folder, err := getSketchDBFolder()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(folder, kind+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+// saveSketchSettings stores the settings of kind of every sketch
+func saveSketchSettings(kind string, settings interface{}) error {
+	folder, err := getSketchDBFolder()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, kind+".json"), data, 0600)
+}
+
 // SketchEvent listens to commands to start and stop sketches
 func (status *Status) SketchEvent(client mqtt.Client, msg mqtt.Message) {
-	var info struct {
-		ID     string
-		Name   string
-		Action string
-	}
+	var info SketchActionPayload
 	err := json.Unmarshal(msg.Payload(), &info)
 	if err != nil {
 		status.Error("/sketch", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
 		return
 	}
 
-	if info.ID == "" {
-		info.ID = info.Name
+	result, err := status.performSketchAction(info)
+	if err != nil {
+		status.Error("/sketch", err)
+		return
 	}
+	status.Info("/sketch", "successfully performed "+info.Action+" on sketch "+result.ID+result.result())
+}
 
-	if sketch, ok := status.Sketches[info.ID]; ok {
-		err := applyAction(sketch, info.Action, status)
-		if err != nil {
-			status.Error("/sketch", errors.Wrapf(err, "applying %s to %s", info.Action, info.Name))
-			return
-		}
-		status.Info("/sketch", "successfully performed "+info.Action+" on sketch "+info.ID)
+// SketchActionPayload asks to perform an action on a sketch
+type SketchActionPayload struct {
+	ID      string
+	Name    string
+	Action  string
+	Version string
+}
 
-		status.Set(info.ID, sketch)
-		status.Publish()
-		return
-	}
+// SketchActionResult is the sketch after an action, and how it was stopped
+type SketchActionResult struct {
+	*SketchStatus
+	Stop string `json:"stop,omitempty"`
+}
 
-	status.Error("/sketch", errors.New("sketch "+info.ID+" not found"))
+func (r SketchActionResult) result() string {
+	if r.Stop == "" {
+		return ""
+	}
+	return " (" + r.Stop + ")"
 }
 
-func natsCloudCB(s *Status) nats.MsgHandler {
-	return func(m *nats.Msg) {
-		thingName := strings.TrimPrefix(m.Subject, "$arduino.cloud.")
+// performSketchAction applies an action (one of applyAction, or ROLLBACK) to a sketch
+// and publishes the new status
+func (status *Status) performSketchAction(info SketchActionPayload) (SketchActionResult, error) {
+	if info.ID == "" {
+		info.ID = info.Name
+	}
 
-		updateMessage := fmt.Sprintf("{\"state\": {\"reported\": { \"%s\": %s}}}", thingName, string(m.Data))
+	sketch, ok := status.Sketches[info.ID]
+	if !ok {
+		return SketchActionResult{}, errors.New("sketch " + info.ID + " not found")
+	}
+	result := SketchActionResult{SketchStatus: sketch}
+	var err error
+	switch info.Action {
+	case "ROLLBACK":
+		err = status.activateSketchVersion(sketch, info.Version)
+	case "STOP":
+		result.Stop, err = status.stopSketch(sketch)
+	default:
+		err = applyAction(sketch, info.Action, status)
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "applying %s to %s", info.Action, info.ID)
+	}
 
-		if s.messagesSent > 1000 {
-			fmt.Println("rate limiting: " + strconv.Itoa(s.messagesSent))
-			introducedDelay := time.Duration(s.messagesSent/1000) * time.Second
-			if introducedDelay > 20*time.Second {
-				introducedDelay = 20 * time.Second
-			}
-			time.Sleep(introducedDelay)
-		}
-		s.messagesSent++
-		s.mqttClient.Publish("$aws/things/"+s.id+"/shadow/update", 1, false, updateMessage)
-		if debugMqtt {
-			fmt.Println("MQTT OUT: $aws/things/"+s.id+"/shadow/update", updateMessage)
-		}
+	if info.Action != "DELETE" {
+		status.Set(info.ID, sketch)
 	}
+	status.Publish()
+	return result, nil
 }
 
 // downloadfile substitute a file with something that downloads from an url
@@ -363,19 +608,19 @@ func logSketchStdoutStderr(cmd *exec.Cmd, stdout io.ReadCloser, stderr io.ReadCl
 	go func() {
 		fmt.Println("started scanning stdout")
 		for stdoutCopy.Scan() {
-			fmt.Printf(stdoutCopy.Text())
+			fmt.Print(stdoutCopy.Text())
 		}
 	}()
 
 	go func() {
 		fmt.Println("started scanning stderr")
 		for stderrCopy.Scan() {
-			fmt.Printf(stderrCopy.Text())
+			fmt.Print(stderrCopy.Text())
 		}
 	}()
 }
 
-func stdInCB(pty *os.File, status *Status) mqtt.MessageHandler {
+func stdInCB(pty io.Writer, status *Status) mqtt.MessageHandler {
 	return func(client mqtt.Client, msg mqtt.Message) {
 		if len(msg.Payload()) > 0 {
 			pty.Write(msg.Payload())
@@ -383,151 +628,29 @@ func stdInCB(pty *os.File, status *Status) mqtt.MessageHandler {
 	}
 }
 
-type dylibMap struct {
-	Name     string   `json:"Name"`
-	Provides []string `json:"Provides"`
-	URL      string   `json:"URL"`
-	Help     string   `json:"Help"`
-}
-
-func (d *dylibMap) Download(path string) {
-	for _, element := range d.Provides {
-		resp, err := http.Get(d.URL + "/" + element)
-		if err != nil {
-			continue
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		filePath := filepath.Join(path, element)
-		ioutil.WriteFile(filePath, body, 0600)
-	}
-}
-
-func (d *dylibMap) Contains(match string) bool {
-	for _, element := range d.Provides {
-		if strings.Contains(element, match) {
-			return true
-		}
-	}
-	return false
-}
-
-func downloadDylibDependencies(library string) error {
-	resp, err := http.Get("https://downloads.arduino.cc/libArduino/dylib_dependencies.txt")
+// spawn Process creates a new process from a file
+func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, io.ReadCloser, io.ReadCloser, error) {
+	cmd, manifest, err := sketchCommand(filepath)
 	if err != nil {
-		return errors.New("Can't download dylibs registry")
+		return 0, nil, nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 200 { // OK
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return errors.New("Can't read dylibs registry")
-		}
-		var v []dylibMap
-		err = json.Unmarshal(bodyBytes, &v)
-		if err != nil {
-			return err
-		}
-		for _, element := range v {
-			if element.Contains(library) {
-				folder, _ := getSketchFolder()
-				fmt.Println(element.Help)
-				if element.Help != "" {
-					// TODO: remove and replace with a status.Info()
-					return errors.New(element.Help)
-				}
-				element.Download(filepath.Join(folder, "lib"))
-			}
-		}
-		return errors.New("Can't find a provider for " + library)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
 	}
-	return nil
-}
-
-func extractLibrary(errorString string) string {
-	fields := strings.Fields(errorString)
-	for _, subStr := range fields {
-		if strings.Contains(subStr, ".so") {
-			subStr = strings.TrimRight(subStr, ":")
-			libName := strings.Split(subStr, ".")
-			if len(libName) >= 2 {
-				return libName[0] + "." + libName[1]
-			}
-		}
+	// let the sketch know who it is, to register its endpoints
+	cmd.Env = append(cmd.Env, "ARDUINO_SKETCH_ID="+sketch.ID)
+	cmd.Env = append(cmd.Env, status.nats.sketchEnv(sketch.ID)...)
+	cmd.Env = append(cmd.Env, status.mqttBroker.sketchEnv()...)
+	sketch.Display = displaySettingsFor(sketch.ID)
+	sketch.displayReported = false
+	sketch.telemetry = status.telemetryParserFor(sketch.ID)
+	if err := applyDisplaySettings(cmd, sketch.Display); err != nil {
+		return 0, nil, nil, errors.Wrap(err, "display")
 	}
-	return ""
-}
-
-func checkForLibrariesMissingError(filepath string, sketch *SketchStatus, status *Status, err string) {
-	if strings.Contains(err, "error while loading shared libraries") {
-		// download dependencies and retry
-		// if the error persists, bail out
-		addIntelLibrariesToLdPath()
-		fmt.Println("Missing library!")
-		library := extractLibrary(err)
-		status.Info("/upload", "Downloading needed libraries")
-		if err := downloadDylibDependencies(library); err != nil {
-			status.Error("/upload", err)
-		}
-		status.Error("/upload", errors.New("Missing libraries, install them and relaunch the sketch"))
-	}
-}
-
-func checkSketchForMissingDisplayEnvVariable(errorString string, filepath string, sketch *SketchStatus, status *Status) {
-	if strings.Contains(errorString, "Can't open display") || strings.Contains(errorString, "cannot open display") {
-
-		if os.Getenv("DISPLAY") == "NULL" {
-			os.Setenv("DISPLAY", ":0")
-			return
-		}
-
-		err := setupDisplay(true)
-		if err != nil {
-			setupDisplay(false)
-		}
-		spawnProcess(filepath, sketch, status)
-		sketch.Status = "RUNNING"
+	if settings := sketchContainerFor(sketch.ID, manifest); settings != nil {
+		pid, err := status.spawnContainer(cmd, sketch, settings)
+		return pid, nil, nil, err
 	}
-}
-
-func setupDisplay(usermode bool) error {
-	// Blindly set DISPLAY env variable to default
-	i := 0
-	for {
-		os.Setenv("DISPLAY", ":"+strconv.Itoa(i))
-		fmt.Println("Exporting DISPLAY as " + ":" + strconv.Itoa(i))
-		// Unlock xorg session for localhost connections
-		// TODO: find a way to automatically remove -nolisten tcp
-		cmd := exec.Command("xhost", "+localhost")
-		if usermode {
-			cmd.SysProcAttr = &syscall.SysProcAttr{}
-			cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 1000, Gid: 1000}
-		}
-		out, errXhost := cmd.CombinedOutput()
-		fmt.Println(string(out))
-		// Also try xrandr
-		cmd = exec.Command("xrandr")
-		out, errXrandr := cmd.CombinedOutput()
-		fmt.Println(string(out))
-		if errXhost != nil || errXrandr != nil {
-			if i > 2 {
-				fmt.Println("Xorg server unavailable, make sure you have a display attached and a user logged in")
-				fmt.Println("If it's already ok, try setting up Xorg to accept incoming connection (-listen tcp)")
-				fmt.Println("On Ubuntu, add \n\n[SeatDefaults]\nxserver-allow-tcp=true\n\nto /etc/lightdm/lightdm.conf")
-				os.Setenv("DISPLAY", "NULL")
-				return errors.New("Unable to open display")
-			}
-		} else {
-			return nil
-		}
-		i++
-	}
-}
-
-// spawn Process creates a new process from a file
-func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, io.ReadCloser, io.ReadCloser, error) {
-	cmd := exec.Command(filepath)
 	stdout, err := cmd.StdoutPipe()
 	stderr, err := cmd.StderrPipe()
 	var stderrBuf bytes.Buffer
@@ -557,8 +680,8 @@ func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, i
 			if len > 0 {
 				//fmt.Println(string(temp[:len]))
 				status.Raw("/stdout", string(temp[:len]))
-				checkForLibrariesMissingError(filepath, sketch, status, string(temp))
-				checkSketchForMissingDisplayEnvVariable(string(temp), filepath, sketch, status)
+				checkSketchForMissingDisplayEnvVariable(string(temp), sketch, status)
+				status.extractTelemetry(sketch, temp[:len])
 			}
 		}
 	}()
@@ -566,69 +689,30 @@ func spawnProcess(filepath string, sketch *SketchStatus, status *Status) (int, i
 	//logSketchStdoutStderr(cmd, stdout, stderr, sketch)
 
 	// keep track of sketch life (and isgnal if it ends abruptly)
+	process := cmd.Process
+	group := newProcessGroup(process.Pid)
+	done := make(chan struct{})
+	sketch.process = process
+	sketch.group = group
+	sketch.done = done
 	go func() {
-		err := cmd.Wait()
+		err := group.wait(cmd, func() {
+			// don't leave orphans behind when the sketch is stopped
+			sketch.mutex.Lock()
+			stopping := sketch.Status == SketchStopping
+			sketch.mutex.Unlock()
+			if stopping {
+				group.kill(syscall.SIGKILL)
+			}
+		})
+		close(done)
 		//if we get here signal that the sketch has died
-		applyAction(sketch, "STOP", status)
 		if err != nil {
 			fmt.Println(fmt.Sprint(err) + ": " + stderrBuf.String())
 		}
 		fmt.Println("sketch exited ")
+		status.sketchExited(sketch, process, err)
 	}()
 
 	return cmd.Process.Pid, stdout, stderr, err
 }
-
-func applyAction(sketch *SketchStatus, action string, status *Status) error {
-	process, err := os.FindProcess(sketch.PID)
-	if err != nil && sketch.PID != 0 {
-		fmt.Println("exit because of error")
-		return err
-	}
-
-	switch action {
-	case "START":
-		if sketch.PID != 0 {
-			err = process.Signal(syscall.SIGCONT)
-		} else {
-			folder, err := getSketchFolder()
-			if err != nil {
-				return err
-			}
-			name := filepath.Join(folder, sketch.Name)
-			sketch.PID, _, _, err = spawnProcess(name, sketch, status)
-		}
-		if err != nil {
-			return err
-		}
-		sketch.Status = "RUNNING"
-		break
-
-	case "STOP":
-		fmt.Println("stop called")
-		if sketch.PID != 0 && err == nil && process.Pid != 0 {
-			fmt.Println("kill called")
-			err = process.Kill()
-		} else {
-			err = nil
-		}
-		sketch.PID = 0
-		sketch.Status = "STOPPED"
-		break
-	case "DELETE":
-		applyAction(sketch, "STOP", status)
-		fmt.Println("delete called")
-		sketchFolder, err := getSketchFolder()
-		err = os.Remove(filepath.Join(sketchFolder, sketch.Name))
-		if err != nil {
-			fmt.Println("error deleting sketch")
-		}
-		status.Sketches[sketch.ID] = nil
-		break
-	case "PAUSE":
-		err = process.Signal(syscall.SIGTSTP)
-		sketch.Status = "PAUSED"
-		break
-	}
-	return err
-}
@@ -71,6 +71,18 @@ type ChangeNamePayload struct {
 	ContainerName string `json:"name"`
 }
 
+// containersPs lists the containers, or the one with the given id
+func (s *Status) containersPs(psPayload PsPayload) ([]types.Container, error) {
+	if s.dockerClient == nil {
+		return nil, errors.New("docker is not available on this device")
+	}
+	containerListOptions := types.ContainerListOptions{All: true}
+	if psPayload.ContainerID != "" {
+		containerListOptions.Filters = filters.NewArgs(filters.Arg("id", psPayload.ContainerID))
+	}
+	return s.dockerClient.ContainerList(context.Background(), containerListOptions)
+}
+
 // ContainersPsEvent implements docker ps -a
 func (s *Status) ContainersPsEvent(client mqtt.Client, msg mqtt.Message) {
 	psPayload := PsPayload{}
@@ -80,12 +92,7 @@ func (s *Status) ContainersPsEvent(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
-	containerListOptions := types.ContainerListOptions{All: true}
-	if psPayload.ContainerID != "" {
-		containerListOptions.Filters = filters.NewArgs(filters.Arg("id", psPayload.ContainerID))
-	}
-
-	containers, err := s.dockerClient.ContainerList(context.Background(), containerListOptions)
+	containers, err := s.containersPs(psPayload)
 	if err != nil {
 		s.Error("/containers/ps", fmt.Errorf("Json marshal result: %s", err))
 		return
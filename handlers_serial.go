@@ -0,0 +1,446 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// data read from a port is sent at most every serialFlushInterval,
+	// in messages of at most serialMaxMessage bytes
+	serialFlushInterval = 50 * time.Millisecond
+	serialMaxMessage    = 16 * 1024
+	// when the rate limit holds back the data, the oldest bytes over serialMaxBuffer are dropped
+	serialMaxBuffer = 256 * 1024
+)
+
+// serialBauds maps the supported baud rates to their termios constants
+var serialBauds = map[int]uint32{
+	1200: unix.B1200, 2400: unix.B2400, 4800: unix.B4800, 9600: unix.B9600,
+	19200: unix.B19200, 38400: unix.B38400, 57600: unix.B57600, 115200: unix.B115200,
+	230400: unix.B230400, 460800: unix.B460800, 500000: unix.B500000, 576000: unix.B576000,
+	921600: unix.B921600, 1000000: unix.B1000000, 2000000: unix.B2000000, 4000000: unix.B4000000,
+}
+
+// SerialPayload is a command sent to /serial/post
+type SerialPayload struct {
+	Action   string `json:"action"`
+	Port     string `json:"port"`
+	Baud     int    `json:"baud,omitempty"`
+	DataBits int    `json:"data_bits,omitempty"`
+	Parity   string `json:"parity,omitempty"`
+	StopBits int    `json:"stop_bits,omitempty"`
+}
+
+// SerialPortInfo describes a serial port of the device
+type SerialPortInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	ByID string `json:"by_id,omitempty"`
+	Open bool   `json:"open"`
+	// Dropped counts the bytes lost because of the rate limit
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// listSerialPorts returns the serial ports backed by a device (USB CDC, USB serial adapters, UARTs)
+func listSerialPorts() []SerialPortInfo {
+	byID := map[string]string{}
+	links, _ := filepath.Glob("/dev/serial/by-id/*")
+	for _, link := range links {
+		if target, err := filepath.EvalSymlinks(link); err == nil {
+			byID[target] = link
+		}
+	}
+
+	var ports []SerialPortInfo
+	devices, _ := filepath.Glob("/sys/class/tty/*/device")
+	for _, device := range devices {
+		name := filepath.Base(filepath.Dir(device))
+		// the 8250 driver lists placeholders for UARTs that don't exist, their type is unknown (0)
+		if uartType, err := ioutil.ReadFile(filepath.Join("/sys/class/tty", name, "type")); err == nil && strings.TrimSpace(string(uartType)) == "0" {
+			continue
+		}
+		path := "/dev/" + name
+		ports = append(ports, SerialPortInfo{Name: name, Path: path, ByID: byID[path]})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports
+}
+
+// openSerialPort opens a tty in raw mode with the given settings
+func openSerialPort(path string, settings SerialPayload) (*os.File, error) {
+	baud, ok := serialBauds[settings.Baud]
+	if !ok {
+		return nil, errors.Errorf("unsupported baud rate %d", settings.Baud)
+	}
+
+	// non blocking, so that a pending read returns when the port is closed
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(file.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "%s is not a tty", path)
+	}
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CBAUD | unix.CRTSCTS
+	termios.Cflag |= unix.CREAD | unix.CLOCAL | baud
+
+	switch settings.DataBits {
+	case 5:
+		termios.Cflag |= unix.CS5
+	case 6:
+		termios.Cflag |= unix.CS6
+	case 7:
+		termios.Cflag |= unix.CS7
+	case 0, 8:
+		termios.Cflag |= unix.CS8
+	default:
+		file.Close()
+		return nil, errors.Errorf("unsupported data bits %d", settings.DataBits)
+	}
+	switch strings.ToLower(settings.Parity) {
+	case "", "none":
+	case "even":
+		termios.Cflag |= unix.PARENB
+	case "odd":
+		termios.Cflag |= unix.PARENB | unix.PARODD
+	default:
+		file.Close()
+		return nil, errors.Errorf("unsupported parity %s", settings.Parity)
+	}
+	switch settings.StopBits {
+	case 0, 1:
+	case 2:
+		termios.Cflag |= unix.CSTOPB
+	default:
+		file.Close()
+		return nil, errors.Errorf("unsupported stop bits %d", settings.StopBits)
+	}
+	termios.Ispeed = baud
+	termios.Ospeed = baud
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "configure %s", path)
+	}
+	return file, nil
+}
+
+// serialBridge moves the data read from a port to publish, buffering it to
+// send few large messages and holding it back when over rateLimit messages per second
+type serialBridge struct {
+	file      *os.File
+	publish   func([]byte)
+	rateLimit int
+
+	mutex   sync.Mutex
+	buffer  []byte
+	dropped int64
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newSerialBridge(file *os.File, rateLimit int, publish func([]byte)) *serialBridge {
+	return &serialBridge{file: file, publish: publish, rateLimit: rateLimit, closed: make(chan struct{})}
+}
+
+func (b *serialBridge) start() {
+	// reader
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := b.file.Read(buf)
+			if n > 0 {
+				b.mutex.Lock()
+				b.buffer = append(b.buffer, buf[:n]...)
+				if over := len(b.buffer) - serialMaxBuffer; over > 0 {
+					b.buffer = b.buffer[over:]
+					b.dropped += int64(over)
+				}
+				b.mutex.Unlock()
+			}
+			if err != nil {
+				b.close()
+				return
+			}
+		}
+	}()
+
+	// flusher
+	go func() {
+		ticker := time.NewTicker(serialFlushInterval)
+		defer ticker.Stop()
+		tokens := float64(b.rateLimit)
+		last := time.Now()
+		for {
+			select {
+			case <-b.closed:
+				// what was read before the end goes out anyway
+				b.mutex.Lock()
+				rest := b.buffer
+				b.buffer = nil
+				b.mutex.Unlock()
+				for len(rest) > 0 {
+					n := len(rest)
+					if n > serialMaxMessage {
+						n = serialMaxMessage
+					}
+					b.publish(rest[:n])
+					rest = rest[n:]
+				}
+				return
+			case now := <-ticker.C:
+				if b.rateLimit > 0 {
+					tokens += now.Sub(last).Seconds() * float64(b.rateLimit)
+					if tokens > float64(b.rateLimit) {
+						tokens = float64(b.rateLimit)
+					}
+				}
+				last = now
+				for b.rateLimit <= 0 || tokens >= 1 {
+					b.mutex.Lock()
+					n := len(b.buffer)
+					if n > serialMaxMessage {
+						n = serialMaxMessage
+					}
+					chunk := append([]byte(nil), b.buffer[:n]...)
+					b.buffer = b.buffer[n:]
+					b.mutex.Unlock()
+					if n == 0 {
+						break
+					}
+					b.publish(chunk)
+					tokens--
+				}
+			}
+		}
+	}()
+}
+
+func (b *serialBridge) write(data []byte) (int, error) {
+	return b.file.Write(data)
+}
+
+func (b *serialBridge) droppedBytes() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.dropped
+}
+
+func (b *serialBridge) close() {
+	b.once.Do(func() {
+		close(b.closed)
+		b.file.Close()
+	})
+}
+
+// serialPort is a port bridged to MQTT and NATS
+type serialPort struct {
+	name   string
+	path   string
+	bridge *serialBridge
+	sub    *nats.Subscription
+}
+
+// subscribeSerialInput writes to the port what is sent on its MQTT topic
+func (status *Status) subscribeSerialInput(client mqtt.Client, port *serialPort) {
+	client.Subscribe("$aws/things/"+status.id+"/serial/"+port.name+"/post", 1, func(client mqtt.Client, msg mqtt.Message) {
+		port.bridge.write(msg.Payload())
+	})
+}
+
+// resubscribeSerialPorts restores the MQTT input of the open ports, the subscriptions
+// are lost when the connection to MQTT is
+func (status *Status) resubscribeSerialPorts(client mqtt.Client) {
+	status.serialMutex.Lock()
+	defer status.serialMutex.Unlock()
+	for _, port := range status.serialPorts {
+		status.subscribeSerialInput(client, port)
+	}
+}
+
+// serialSubject is where what the port named name receives is published on NATS,
+// what is published on <subject>.write is written to the port
+func serialSubject(name string) string {
+	return "$arduino.serial." + subjectToken(name)
+}
+
+// resolveSerialPort finds port (ttyACM0, /dev/ttyACM0 or its /dev/serial/by-id link) among
+// the serial ports of the device, other ttys (terminals, ptys) can't be opened
+func resolveSerialPort(port string, ports []SerialPortInfo) (string, string, error) {
+	if port == "" {
+		return "", "", errors.New("missing port")
+	}
+	for _, candidate := range ports {
+		if port == candidate.Name || filepath.Clean(port) == candidate.Path || (candidate.ByID != "" && port == candidate.ByID) {
+			return candidate.Name, candidate.Path, nil
+		}
+	}
+	return "", "", errors.New(port + " is not a serial port of the device")
+}
+
+// SerialEvent lists, opens and closes the serial ports bridged to MQTT and NATS
+func (status *Status) SerialEvent(client mqtt.Client, msg mqtt.Message) {
+	var info SerialPayload
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		status.Error("/serial", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+
+	switch info.Action {
+	case "list":
+		ports := listSerialPorts()
+		status.serialMutex.Lock()
+		for i := range ports {
+			if open, ok := status.serialPorts[ports[i].Name]; ok {
+				ports[i].Open = true
+				ports[i].Dropped = open.bridge.droppedBytes()
+			}
+		}
+		status.serialMutex.Unlock()
+		data, err := json.Marshal(ports)
+		if err != nil {
+			status.Error("/serial", errors.Wrap(err, "json marshal"))
+			return
+		}
+		status.Info("/serial", string(data)+"\n")
+		return
+	case "open":
+		err = status.openSerial(info)
+	case "close":
+		err = status.closeSerial(info.Port)
+	default:
+		err = errors.New("unknown action " + info.Action)
+	}
+	if err != nil {
+		status.Error("/serial", errors.Wrapf(err, "%s %s", info.Action, info.Port))
+		return
+	}
+	status.Info("/serial", "successfully performed "+info.Action+" on "+info.Port)
+}
+
+func (status *Status) openSerial(info SerialPayload) error {
+	name, path, err := resolveSerialPort(info.Port, listSerialPorts())
+	if err != nil {
+		return err
+	}
+	if info.Baud == 0 {
+		info.Baud = 9600
+	}
+
+	status.serialMutex.Lock()
+	defer status.serialMutex.Unlock()
+	if _, ok := status.serialPorts[name]; ok {
+		return errors.New(name + " is already open")
+	}
+
+	file, err := openSerialPort(path, info)
+	if err != nil {
+		return err
+	}
+
+	subject := serialSubject(name)
+	port := &serialPort{name: name, path: path}
+	port.bridge = newSerialBridge(file, status.config.SerialRateLimit, func(data []byte) {
+		status.Stream("/serial/"+name, string(data))
+		if status.natsClient != nil {
+			status.natsClient.Publish(subject, data)
+		}
+	})
+
+	if status.mqttClient != nil {
+		status.subscribeSerialInput(status.mqttClient, port)
+	}
+	if status.natsClient != nil {
+		port.sub, err = status.natsClient.Subscribe(subject+".write", func(m *nats.Msg) {
+			port.bridge.write(m.Data)
+		})
+		if err != nil {
+			file.Close()
+			return errors.Wrap(err, "subscribe "+subject+".write")
+		}
+	}
+
+	port.bridge.start()
+	status.serialPorts[name] = port
+
+	// forget the port if it goes away (eg. the board is unplugged)
+	go func() {
+		<-port.bridge.closed
+		status.serialMutex.Lock()
+		if status.serialPorts[name] == port {
+			delete(status.serialPorts, name)
+			status.unsubscribeSerial(port)
+		}
+		status.serialMutex.Unlock()
+	}()
+	return nil
+}
+
+func (status *Status) closeSerial(portName string) error {
+	status.serialMutex.Lock()
+	var open []SerialPortInfo
+	for _, port := range status.serialPorts {
+		open = append(open, SerialPortInfo{Name: port.name, Path: port.path})
+	}
+	name, _, err := resolveSerialPort(portName, open)
+	port := status.serialPorts[name]
+	delete(status.serialPorts, name)
+	status.serialMutex.Unlock()
+	if err != nil {
+		return errors.New(portName + " is not open")
+	}
+
+	status.unsubscribeSerial(port)
+	port.bridge.close()
+	return nil
+}
+
+func (status *Status) unsubscribeSerial(port *serialPort) {
+	if status.mqttClient != nil {
+		status.mqttClient.Unsubscribe("$aws/things/" + status.id + "/serial/" + port.name + "/post")
+	}
+	if port.sub != nil {
+		port.sub.Unsubscribe()
+	}
+}
@@ -0,0 +1,125 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSerialBridgePty bridges the slave side of a pty pair, the master side plays the board
+func TestSerialBridgePty(t *testing.T) {
+	board, tty, err := pty.Open()
+	if err != nil {
+		t.Skip("no pty available: " + err.Error())
+	}
+	defer board.Close()
+	defer tty.Close()
+
+	_, err = openSerialPort(tty.Name(), SerialPayload{Baud: 12345})
+	assert.Error(t, err)
+
+	port, err := openSerialPort(tty.Name(), SerialPayload{Baud: 115200, Parity: "even"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	received := make(chan []byte, 100)
+	bridge := newSerialBridge(port, 10, func(data []byte) { received <- data })
+	bridge.start()
+	defer bridge.close()
+
+	// board -> bridge, small writes are buffered in a single message
+	board.Write([]byte("hello "))
+	board.Write([]byte("world"))
+	var got []byte
+	timeout := time.After(2 * time.Second)
+	for string(got) != "hello world" {
+		select {
+		case data := <-received:
+			got = append(got, data...)
+		case <-timeout:
+			t.Fatalf("received %q", got)
+		}
+	}
+
+	// bridge -> board
+	_, err = bridge.write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(board, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// closing the port stops the bridge in both directions
+	bridge.close()
+	_, err = bridge.write([]byte("pong"))
+	assert.Error(t, err)
+	board.Write([]byte("late\n"))
+	select {
+	case data := <-received:
+		t.Errorf("received %q after closing", data)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestResolveSerialPort(t *testing.T) {
+	ports := []SerialPortInfo{
+		{Name: "ttyACM0", Path: "/dev/ttyACM0", ByID: "/dev/serial/by-id/usb-Arduino_Uno-if00"},
+		{Name: "ttyS0", Path: "/dev/ttyS0"},
+	}
+	tests := []struct {
+		port, name, err string
+	}{
+		{"ttyACM0", "ttyACM0", ""},
+		{"/dev/ttyACM0", "ttyACM0", ""},
+		{"/dev/serial/by-id/usb-Arduino_Uno-if00", "ttyACM0", ""},
+		{"/dev/../dev/ttyS0", "ttyS0", ""},
+		{"", "", "missing port"},
+		{"/dev/pts/0", "", "not a serial port"},
+		{"tty1", "", "not a serial port"},
+		{"/dev/tty1", "", "not a serial port"},
+		{"/tmp/ttyACM0", "", "not a serial port"},
+	}
+	for _, test := range tests {
+		name, _, err := resolveSerialPort(test.port, ports)
+		assert.Equal(t, test.name, name, test.port)
+		if test.err == "" {
+			assert.NoError(t, err, test.port)
+		} else if assert.Error(t, err, test.port) {
+			assert.Contains(t, err.Error(), test.err, test.port)
+		}
+	}
+}
+
+func TestSerialOutputNotThrottled(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	// Raw would sleep for 5 seconds
+	status.messagesSent = 5000
+	start := time.Now()
+	status.Stream("/serial/ttyACM0", "hello")
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 5000, status.messagesSent)
+	assert.Equal(t, []string{"$aws/things/dev/serial/ttyACM0 hello"}, client.take())
+}
@@ -0,0 +1,319 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kr/pty"
+	"github.com/pkg/errors"
+)
+
+// shellRateLimit is how many output messages per second are sent for each session
+const shellRateLimit = 20
+
+// ShellPayload is a command sent to /shell/post
+type ShellPayload struct {
+	Action string `json:"action"`
+	ID     string `json:"id,omitempty"`
+	// Identity is who sends the command, it must be one of shell_identities
+	Identity string `json:"identity,omitempty"`
+	Cols     uint16 `json:"cols,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+}
+
+// ShellInfo describes an open shell session
+type ShellInfo struct {
+	ID        string    `json:"id"`
+	Identity  string    `json:"identity"`
+	StartedAt time.Time `json:"started_at"`
+	// Input is the topic to send the keystrokes to, the output is published on Output
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// shellSession is a shell running in a pty
+type shellSession struct {
+	info         ShellInfo
+	cmd          *exec.Cmd
+	group        *processGroup
+	pty          *os.File
+	mutex        sync.Mutex
+	lastActivity time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+	// output streams the terminal like a serial port, with its own rate limit
+	output *serialBridge
+}
+
+func (s *shellSession) touch() {
+	s.mutex.Lock()
+	s.lastActivity = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *shellSession) idleFor() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Since(s.lastActivity)
+}
+
+func newShellID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// shellCommand returns the command run in the sessions
+func shellCommand(config Config) *exec.Cmd {
+	args := strings.Fields(config.ShellCommand)
+	if len(args) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		args = []string{shell, "-l"}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	if home := os.Getenv("HOME"); home != "" {
+		cmd.Dir = home
+	}
+	return cmd
+}
+
+// shellIdentityAllowed tells if identity is one of those listed in shell_identities
+func shellIdentityAllowed(config Config, identity string) bool {
+	for _, allowed := range strings.Split(config.ShellIdentities, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && allowed == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// ShellEvent opens, resizes, lists and closes remote shell sessions
+func (status *Status) ShellEvent(client mqtt.Client, msg mqtt.Message) {
+	if !status.config.ShellEnabled {
+		status.Error("/shell", errors.New("the remote shell is disabled, set shell_enabled=true in the configuration of the device to enable it"))
+		return
+	}
+
+	var info ShellPayload
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		status.Error("/shell", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	if !shellIdentityAllowed(status.config, info.Identity) {
+		log.Printf("Shell %s refused to %q", info.Action, info.Identity)
+		status.Error("/shell", errors.Errorf("%q is not allowed to use the remote shell, see shell_identities", info.Identity))
+		return
+	}
+
+	switch info.Action {
+	case "open":
+		err = status.openShell(info)
+	case "resize":
+		err = status.resizeShell(info)
+	case "close":
+		err = status.closeShell(info.ID, "closed by "+info.Identity)
+	case "list":
+		status.shellsMutex.Lock()
+		sessions := []ShellInfo{}
+		for _, session := range status.shells {
+			sessions = append(sessions, session.info)
+		}
+		status.shellsMutex.Unlock()
+		var data []byte
+		data, err = json.Marshal(sessions)
+		if err == nil {
+			status.Info("/shell", string(data)+"\n")
+		}
+	default:
+		err = errors.New("unknown action " + info.Action)
+	}
+	if err != nil {
+		status.Error("/shell", errors.Wrapf(err, "shell %s", info.Action))
+	}
+}
+
+// subscribeShellInput writes the keystrokes sent on the input topic of a session to its terminal
+func subscribeShellInput(client mqtt.Client, session *shellSession) {
+	client.Subscribe(session.info.Input, 1, func(client mqtt.Client, msg mqtt.Message) {
+		session.touch()
+		session.pty.Write(msg.Payload())
+	})
+}
+
+// resubscribeShells restores the input of the open sessions, the subscriptions
+// are lost when the connection to MQTT is
+func (status *Status) resubscribeShells(client mqtt.Client) {
+	status.shellsMutex.Lock()
+	defer status.shellsMutex.Unlock()
+	for _, session := range status.shells {
+		subscribeShellInput(client, session)
+	}
+}
+
+func (status *Status) openShell(info ShellPayload) error {
+	id, err := newShellID()
+	if err != nil {
+		return err
+	}
+	prefix := "$aws/things/" + status.id + "/shell/" + id
+	session := &shellSession{
+		info: ShellInfo{
+			ID:        id,
+			Identity:  info.Identity,
+			StartedAt: time.Now(),
+			Input:     prefix + "/post",
+			Output:    prefix,
+		},
+		cmd:          shellCommand(status.config),
+		lastActivity: time.Now(),
+		closed:       make(chan struct{}),
+	}
+
+	// the session is complete before the others can see it
+	status.shellsMutex.Lock()
+	if len(status.shells) >= status.config.ShellMaxSessions {
+		status.shellsMutex.Unlock()
+		return errors.Errorf("too many shell sessions (%d)", len(status.shells))
+	}
+	session.pty, err = pty.Start(session.cmd)
+	if err != nil {
+		status.shellsMutex.Unlock()
+		return err
+	}
+	session.group = newProcessGroup(session.cmd.Process.Pid)
+	session.output = newSerialBridge(session.pty, shellRateLimit, func(data []byte) {
+		session.touch()
+		status.Stream("/shell/"+id, string(data))
+	})
+	status.shells[id] = session
+	status.shellsMutex.Unlock()
+
+	if info.Cols > 0 && info.Rows > 0 {
+		pty.Setsize(session.pty, &pty.Winsize{Cols: info.Cols, Rows: info.Rows})
+	}
+	log.Printf("Shell session %s opened by %q", id, info.Identity)
+
+	// the session is announced before anything it does can be published
+	data, err := json.Marshal(session.info)
+	if err != nil {
+		status.closeShell(id, "internal error")
+		return err
+	}
+	status.Info("/shell", string(data)+"\n")
+
+	if status.mqttClient != nil {
+		subscribeShellInput(status.mqttClient, session)
+	}
+	session.output.start()
+
+	// exit
+	go func() {
+		session.group.wait(session.cmd, func() {
+			// the session is over, hang up what is left of it
+			session.group.kill(syscall.SIGKILL)
+		})
+		status.closeShell(id, "shell exited")
+	}()
+
+	// idle timeout
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-session.closed:
+				return
+			case <-ticker.C:
+				if status.config.ShellIdleTimeout > 0 && session.idleFor() > status.config.ShellIdleTimeout {
+					status.closeShell(id, "idle timeout")
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (status *Status) resizeShell(info ShellPayload) error {
+	status.shellsMutex.Lock()
+	session, ok := status.shells[info.ID]
+	status.shellsMutex.Unlock()
+	if !ok {
+		return errors.New("shell session " + info.ID + " not found")
+	}
+	if info.Cols == 0 || info.Rows == 0 {
+		return errors.New("cols and rows are required")
+	}
+	session.touch()
+	return pty.Setsize(session.pty, &pty.Winsize{Cols: info.Cols, Rows: info.Rows})
+}
+
+// closeShell ends a session, killing the processes started in it
+func (status *Status) closeShell(id, reason string) error {
+	status.shellsMutex.Lock()
+	session, ok := status.shells[id]
+	delete(status.shells, id)
+	status.shellsMutex.Unlock()
+	if !ok {
+		return errors.New("shell session " + id + " not found")
+	}
+
+	session.closeOnce.Do(func() {
+		close(session.closed)
+		if status.mqttClient != nil {
+			status.mqttClient.Unsubscribe(session.info.Input)
+		}
+		// the shell is a session leader, hang up its whole process group
+		if session.group != nil {
+			session.group.kill(syscall.SIGHUP)
+			time.AfterFunc(time.Second, func() {
+				session.group.kill(syscall.SIGKILL)
+			})
+		}
+		session.output.close()
+
+		log.Printf("Shell session %s opened by %q closed after %s: %s", id, session.info.Identity,
+			time.Since(session.info.StartedAt).Round(time.Second), reason)
+		data, _ := json.Marshal(struct {
+			ID     string `json:"id"`
+			Closed string `json:"closed"`
+		}{id, reason})
+		status.Info("/shell", string(data)+"\n")
+	})
+	return nil
+}
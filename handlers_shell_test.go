@@ -0,0 +1,163 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscribingClient records what is published and keeps the handlers of the subscriptions
+type subscribingClient struct {
+	*recordingClient
+	mutex    sync.Mutex
+	handlers map[string]mqtt.MessageHandler
+}
+
+func newSubscribingClient() *subscribingClient {
+	return &subscribingClient{recordingClient: &recordingClient{}, handlers: map[string]mqtt.MessageHandler{}}
+}
+
+func (c *subscribingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handlers[topic] = callback
+	return doneToken{}
+}
+
+func (c *subscribingClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, topic := range topics {
+		delete(c.handlers, topic)
+	}
+	return doneToken{}
+}
+
+func (c *subscribingClient) handler(topic string) mqtt.MessageHandler {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.handlers[topic]
+}
+
+// waitPublished waits for a message containing text, and returns all those published meanwhile
+func waitPublished(client *subscribingClient, text string) []string {
+	var published []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		published = append(published, client.take()...)
+		for _, message := range published {
+			if strings.Contains(message, text) {
+				return published
+			}
+		}
+	}
+	return published
+}
+
+func TestShellIdentities(t *testing.T) {
+	tests := []struct {
+		identities, identity string
+		allowed              bool
+	}{
+		{"", "", false},
+		{"", "jane@example.com", false},
+		{"jane@example.com", "jane@example.com", true},
+		{"jane@example.com, joe@example.com", "joe@example.com", true},
+		{"jane@example.com,", "", false},
+		{"jane@example.com", "Jane@example.com", false},
+		{"jane@example.com", "jane", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, shellIdentityAllowed(Config{ShellIdentities: test.identities}, test.identity), test)
+	}
+
+	client := newSubscribingClient()
+	status := NewStatus("dev", client, nil)
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "open", "identity": "jane@example.com"}`})
+	assert.Contains(t, client.take()[0], "the remote shell is disabled")
+
+	status.config = Config{ShellEnabled: true, ShellIdentities: "jane@example.com", ShellMaxSessions: 1}
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "open", "identity": "mallory@example.com"}`})
+	assert.Equal(t, []string{`$aws/things/dev/shell ERROR: "mallory@example.com" is not allowed to use the remote shell, see shell_identities` + "\n"}, client.take())
+	assert.Empty(t, status.shells)
+}
+
+func TestShellSession(t *testing.T) {
+	client := newSubscribingClient()
+	status := NewStatus("dev", client, nil)
+	status.config = Config{ShellEnabled: true, ShellIdentities: "jane@example.com", ShellCommand: "cat", ShellMaxSessions: 1}
+
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "open", "identity": "jane@example.com", "cols": 80, "rows": 24}`})
+	status.shellsMutex.Lock()
+	var session *shellSession
+	for _, open := range status.shells {
+		session = open
+	}
+	status.shellsMutex.Unlock()
+	if !assert.NotNil(t, session) {
+		return
+	}
+	assert.Contains(t, client.take()[0], `"identity":"jane@example.com"`)
+
+	// the keystrokes go to the terminal, its output comes back
+	client.handler(session.info.Input)(client, payloadMessage{payload: "hello\n"})
+	published := waitPublished(client, "hello")
+	assert.Contains(t, strings.Join(published, ""), "$aws/things/dev/shell/"+session.info.ID+" hello")
+
+	// only one session at a time here
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "open", "identity": "jane@example.com"}`})
+	assert.Contains(t, client.take()[0], "too many shell sessions (1)")
+
+	// the input is subscribed again after a reconnection
+	client.Unsubscribe(session.info.Input)
+	status.resubscribeShells(client)
+	assert.NotNil(t, client.handler(session.info.Input))
+
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "close", "identity": "jane@example.com", "id": "` + session.info.ID + `"}`})
+	assert.Contains(t, strings.Join(waitPublished(client, `"closed"`), ""), `"closed":"closed by jane@example.com"`)
+	status.shellsMutex.Lock()
+	assert.Empty(t, status.shells)
+	status.shellsMutex.Unlock()
+	assert.Nil(t, client.handler(session.info.Input))
+	select {
+	case <-session.closed:
+	case <-time.After(time.Second):
+		t.Error("the session isn't closed")
+	}
+
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "close", "identity": "jane@example.com", "id": "` + session.info.ID + `"}`})
+	assert.Contains(t, client.take()[0], "not found")
+}
+
+func TestShellSessionExit(t *testing.T) {
+	client := newSubscribingClient()
+	status := NewStatus("dev", client, nil)
+	status.config = Config{ShellEnabled: true, ShellIdentities: "jane@example.com", ShellCommand: "true", ShellMaxSessions: 1}
+
+	status.ShellEvent(client, payloadMessage{payload: `{"action": "open", "identity": "jane@example.com"}`})
+	assert.Contains(t, strings.Join(waitPublished(client, `"closed"`), ""), `"closed":"shell exited"`)
+	status.shellsMutex.Lock()
+	assert.Empty(t, status.shells)
+	status.shellsMutex.Unlock()
+}
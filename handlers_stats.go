@@ -86,34 +86,44 @@ func checkAndInstallNetworkManager() {
 	}
 }
 
-// StatsEvent sends statistics about resource used in the system (RAM, Disk, Network, etc...)
-func (s *Status) StatsEvent(client mqtt.Client, msg mqtt.Message) {
-	// Gather all system data metrics
+// StatsPayload are the statistics about the resources of the system
+type StatsPayload struct {
+	Memory  *mem.Stats      `json:"memory"`
+	Disk    []*disk.FSStats `json:"disk"`
+	Network *net.Stats      `json:"network"`
+}
+
+// systemStats gathers the statistics, the errors are those of the stats not available
+func systemStats() (StatsPayload, []error) {
+	var errs []error
 	memStats, err := mem.GetStats()
 	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving memory stats: %s", err))
+		errs = append(errs, fmt.Errorf("Retrieving memory stats: %s", err))
 	}
 
 	diskStats, err := disk.GetStats()
 	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving disk stats: %s", err))
+		errs = append(errs, fmt.Errorf("Retrieving disk stats: %s", err))
 	}
 
 	netStats, err := net.GetNetworkStats()
 	if err != nil {
-		s.Error("/stats", fmt.Errorf("Retrieving network stats: %s", err))
-	}
-
-	type StatsPayload struct {
-		Memory  *mem.Stats      `json:"memory"`
-		Disk    []*disk.FSStats `json:"disk"`
-		Network *net.Stats      `json:"network"`
+		errs = append(errs, fmt.Errorf("Retrieving network stats: %s", err))
 	}
 
-	info := StatsPayload{
+	return StatsPayload{
 		Memory:  memStats,
 		Disk:    diskStats,
 		Network: netStats,
+	}, errs
+}
+
+// StatsEvent sends statistics about resource used in the system (RAM, Disk, Network, etc...)
+func (s *Status) StatsEvent(client mqtt.Client, msg mqtt.Message) {
+	// Gather all system data metrics
+	info, errs := systemStats()
+	for _, err := range errs {
+		s.Error("/stats", err)
 	}
 
 	// Send result
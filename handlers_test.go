@@ -0,0 +1,63 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSketchName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"blink", ""},
+		{"blink.bin", ""},
+		{"sketch-1", ""},
+		{"", "invalid sketch name"},
+		{".", "invalid sketch name"},
+		{"..", "invalid sketch name"},
+		{"/", "invalid sketch name"},
+		{"lib/blink", "invalid sketch name"},
+		{"staging", "reserved name"},
+		{"previous", "reserved name"},
+		{"versions", "reserved name"},
+		{"db", "reserved name"},
+		{"lib", "reserved name"},
+		{"bundles", "reserved name"},
+		{"dylib-cache", "reserved name"},
+	}
+	for _, test := range tests {
+		err := checkSketchName(test.name)
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+
+	// the binary is left alone
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.installSketch("blink", "/tmp/../lib", "", "/nonexistent")
+	assert.Equal(t, []string{`$aws/things/dev/upload ERROR: install sketch blink: "lib" is a reserved name, it can't be used for a sketch` + "\n"}, client.take())
+	assert.Empty(t, status.Sketches)
+}
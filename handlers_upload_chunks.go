@@ -0,0 +1,334 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultChunkSize keeps every base64 encoded chunk well below the 128KB AWS IoT message limit
+	defaultChunkSize = 64 * 1024
+	maxChunkSize     = 96 * 1024
+	// maxChunks bounds the bookkeeping of an upload, whatever its chunk size
+	maxChunks = 64 * 1024
+	// maxChunkedUploads is how many uploads can be in progress at the same time
+	maxChunkedUploads = 4
+	// uploads without activity for this long are discarded
+	chunkedUploadExpiration = time.Hour
+)
+
+// ChunkPayload is a message of the chunked upload protocol
+type ChunkPayload struct {
+	Action    string `json:"action"`
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	ChunkSize int64  `json:"chunk_size,omitempty"`
+	Index     int    `json:"index"`
+	Data      string `json:"data,omitempty"`
+}
+
+// ChunkProgress is the reply sent to begin and status requests, it lists the
+// chunks still missing so that an interrupted upload can be resumed
+type ChunkProgress struct {
+	ID        string `json:"id"`
+	Chunks    int    `json:"chunks"`
+	ChunkSize int64  `json:"chunk_size"`
+	Missing   []int  `json:"missing"`
+}
+
+// chunkedUpload holds the state of an upload being reassembled
+type chunkedUpload struct {
+	sync.Mutex
+	id           string
+	name         string
+	size         int64
+	sha256       string
+	signature    string
+	chunkSize    int64
+	received     []bool
+	file         *os.File
+	lastActivity time.Time
+	// closed is set when the file is committed or discarded
+	closed bool
+}
+
+func (u *chunkedUpload) progress() ChunkProgress {
+	p := ChunkProgress{ID: u.id, Chunks: len(u.received), ChunkSize: u.chunkSize, Missing: []int{}}
+	for i, ok := range u.received {
+		if !ok {
+			p.Missing = append(p.Missing, i)
+		}
+	}
+	return p
+}
+
+func (u *chunkedUpload) write(index int, data []byte) error {
+	if u.closed {
+		return errors.New("upload not found")
+	}
+	if index < 0 || index >= len(u.received) {
+		return fmt.Errorf("chunk %d out of range [0, %d)", index, len(u.received))
+	}
+	expected := u.chunkSize
+	if last := u.size - int64(index)*u.chunkSize; last < expected {
+		expected = last
+	}
+	if int64(len(data)) != expected {
+		return fmt.Errorf("chunk %d has size %d, expected %d", index, len(data), expected)
+	}
+	if _, err := u.file.WriteAt(data, int64(index)*u.chunkSize); err != nil {
+		return err
+	}
+	u.received[index] = true
+	u.lastActivity = time.Now()
+	return nil
+}
+
+// close closes the file, the caller holds the lock of the upload
+func (u *chunkedUpload) close() {
+	if !u.closed {
+		u.closed = true
+		u.file.Close()
+	}
+}
+
+func (u *chunkedUpload) discard() {
+	u.Lock()
+	defer u.Unlock()
+	u.close()
+	os.Remove(u.file.Name())
+}
+
+// UploadChunkEvent receives a sketch binary split in base64 encoded chunks.
+// An upload is opened with a begin action, filled with chunk actions in any order
+// and completed with a commit action which verifies the binary and starts it.
+// Sending begin again with the same id and sha256 returns the missing chunks.
+func (status *Status) UploadChunkEvent(client mqtt.Client, msg mqtt.Message) {
+	var payload ChunkPayload
+	err := json.Unmarshal(msg.Payload(), &payload)
+	if err != nil {
+		status.Error("/upload/chunk", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+
+	if payload.ID == "" {
+		payload.ID = payload.Name
+	}
+	if payload.ID == "" {
+		status.Error("/upload/chunk", errors.New("missing upload id"))
+		return
+	}
+
+	switch payload.Action {
+	case "begin":
+		err = status.beginChunkedUpload(payload)
+	case "status":
+		err = status.replyChunkedUploadProgress(payload.ID)
+	case "chunk":
+		err = status.writeChunk(payload)
+	case "commit":
+		err = status.commitChunkedUpload(payload.ID)
+	case "abort":
+		if upload := status.takeChunkedUpload(payload.ID); upload != nil {
+			upload.discard()
+		}
+		status.Info("/upload/chunk", "upload "+payload.ID+" aborted")
+	default:
+		err = fmt.Errorf("unknown action %s", payload.Action)
+	}
+	if err != nil {
+		status.Error("/upload/chunk", errors.Wrapf(err, "%s %s", payload.Action, payload.ID))
+	}
+}
+
+func (status *Status) beginChunkedUpload(payload ChunkPayload) error {
+	if payload.Name == "" || payload.Size <= 0 || payload.SHA256 == "" {
+		return errors.New("name, size and sha256 are mandatory")
+	}
+	if payload.ChunkSize == 0 {
+		payload.ChunkSize = defaultChunkSize
+	}
+	if payload.ChunkSize < 0 || payload.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size must be between 1 and %d", maxChunkSize)
+	}
+	if maxSize := status.config.SketchMaxSize * 1024 * 1024; maxSize > 0 && payload.Size > maxSize {
+		return fmt.Errorf("size %d is more than the maximum of %d", payload.Size, maxSize)
+	}
+	chunks := payload.Size / payload.ChunkSize
+	if payload.Size%payload.ChunkSize != 0 {
+		chunks++
+	}
+	if chunks > maxChunks {
+		return fmt.Errorf("%d chunks are too many, the maximum is %d", chunks, maxChunks)
+	}
+
+	status.uploadsMutex.Lock()
+	defer status.uploadsMutex.Unlock()
+
+	status.expireChunkedUploads()
+
+	// resume the upload if it refers to the same binary
+	if upload, ok := status.uploads[payload.ID]; ok {
+		upload.Lock()
+		same := upload.sha256 == payload.SHA256 && upload.size == payload.Size && upload.chunkSize == payload.ChunkSize
+		upload.Unlock()
+		if same {
+			return status.replyProgress(upload)
+		}
+		upload.discard()
+		delete(status.uploads, payload.ID)
+	}
+	if len(status.uploads) >= maxChunkedUploads {
+		return fmt.Errorf("too many uploads in progress, the maximum is %d", maxChunkedUploads)
+	}
+
+	file, err := ioutil.TempFile("", "sketch-chunks-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file")
+	}
+	if err := file.Truncate(payload.Size); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return errors.Wrap(err, "allocate temporary file")
+	}
+
+	upload := &chunkedUpload{
+		id:           payload.ID,
+		name:         filepath.Base(payload.Name),
+		size:         payload.Size,
+		sha256:       payload.SHA256,
+		signature:    payload.Signature,
+		chunkSize:    payload.ChunkSize,
+		received:     make([]bool, chunks),
+		file:         file,
+		lastActivity: time.Now(),
+	}
+	status.uploads[payload.ID] = upload
+	return status.replyProgress(upload)
+}
+
+func (status *Status) replyChunkedUploadProgress(id string) error {
+	status.uploadsMutex.Lock()
+	upload, ok := status.uploads[id]
+	status.uploadsMutex.Unlock()
+	if !ok {
+		return errors.New("upload not found")
+	}
+	return status.replyProgress(upload)
+}
+
+func (status *Status) replyProgress(upload *chunkedUpload) error {
+	upload.Lock()
+	progress := upload.progress()
+	upload.Unlock()
+
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return errors.Wrap(err, "json marshal result")
+	}
+	status.Info("/upload/chunk", string(data)+"\n")
+	return nil
+}
+
+func (status *Status) writeChunk(payload ChunkPayload) error {
+	status.uploadsMutex.Lock()
+	upload, ok := status.uploads[payload.ID]
+	status.uploadsMutex.Unlock()
+	if !ok {
+		return errors.New("upload not found, send begin first")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload.Data)
+	if err != nil {
+		return errors.Wrapf(err, "decode chunk %d", payload.Index)
+	}
+
+	upload.Lock()
+	defer upload.Unlock()
+	return upload.write(payload.Index, data)
+}
+
+func (status *Status) commitChunkedUpload(id string) error {
+	status.uploadsMutex.Lock()
+	upload, ok := status.uploads[id]
+	if ok {
+		upload.Lock()
+		missing := len(upload.progress().Missing)
+		upload.Unlock()
+		if missing > 0 {
+			status.uploadsMutex.Unlock()
+			return fmt.Errorf("%d chunks are still missing", missing)
+		}
+		delete(status.uploads, id)
+	}
+	status.uploadsMutex.Unlock()
+	if !ok {
+		return errors.New("upload not found")
+	}
+
+	upload.Lock()
+	upload.close()
+	upload.Unlock()
+	defer os.Remove(upload.file.Name())
+
+	err := verifySketch(upload.file.Name(), upload.sha256, upload.signature, status.config)
+	if err != nil {
+		return errors.Wrapf(err, "verify sketch %s", upload.name)
+	}
+
+	status.Info("/upload/chunk", "upload "+id+" completed")
+	status.installSketch(upload.id, upload.name, "", upload.file.Name())
+	return nil
+}
+
+func (status *Status) takeChunkedUpload(id string) *chunkedUpload {
+	status.uploadsMutex.Lock()
+	defer status.uploadsMutex.Unlock()
+	upload := status.uploads[id]
+	delete(status.uploads, id)
+	return upload
+}
+
+// expireChunkedUploads discards the uploads abandoned by their sender,
+// it must be called with uploadsMutex held
+func (status *Status) expireChunkedUploads() {
+	for id, upload := range status.uploads {
+		upload.Lock()
+		expired := time.Since(upload.lastActivity) > chunkedUploadExpiration
+		upload.Unlock()
+		if expired {
+			upload.discard()
+			delete(status.uploads, id)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunkMessage(payload ChunkPayload) payloadMessage {
+	data, _ := json.Marshal(payload)
+	return payloadMessage{payload: string(data)}
+}
+
+func chunkData(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestUploadChunks(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	binary := []byte("0123456789")
+	begin := ChunkPayload{Action: "begin", ID: "blink", Name: "blink", Size: int64(len(binary)), SHA256: "00", ChunkSize: 4}
+
+	status.UploadChunkEvent(client, chunkMessage(begin))
+	assert.Equal(t, []string{`$aws/things/dev/upload/chunk INFO: {"id":"blink","chunks":3,"chunk_size":4,"missing":[0,1,2]}` + "\n\n"}, client.take())
+	upload := status.uploads["blink"]
+	defer upload.discard()
+
+	// chunks arrive in any order, a duplicate is written again
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 2, Data: chunkData(binary[8:])}))
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 0, Data: chunkData(binary[:4])}))
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 0, Data: chunkData(binary[:4])}))
+	assert.Empty(t, client.take())
+
+	// past the end, or of the wrong size
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 3, Data: chunkData(binary[:2])}))
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: -1, Data: chunkData(binary[:4])}))
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 1, Data: chunkData(binary[4:9])}))
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 2, Data: chunkData(binary[8:9])}))
+	assert.Equal(t, []string{
+		"$aws/things/dev/upload/chunk ERROR: chunk blink: chunk 3 out of range [0, 3)\n",
+		"$aws/things/dev/upload/chunk ERROR: chunk blink: chunk -1 out of range [0, 3)\n",
+		"$aws/things/dev/upload/chunk ERROR: chunk blink: chunk 1 has size 5, expected 4\n",
+		"$aws/things/dev/upload/chunk ERROR: chunk blink: chunk 2 has size 1, expected 2\n",
+	}, client.take())
+
+	// a resumed upload only needs the missing chunks
+	status.UploadChunkEvent(client, chunkMessage(begin))
+	assert.Equal(t, []string{`$aws/things/dev/upload/chunk INFO: {"id":"blink","chunks":3,"chunk_size":4,"missing":[1]}` + "\n\n"}, client.take())
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "commit", ID: "blink"}))
+	assert.Equal(t, []string{"$aws/things/dev/upload/chunk ERROR: commit blink: 1 chunks are still missing\n"}, client.take())
+
+	// the binary doesn't match the declared hash
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 1, Data: chunkData(binary[4:8])}))
+	data, _ := ioutil.ReadFile(upload.file.Name())
+	assert.Equal(t, binary, data)
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "commit", ID: "blink"}))
+	published := client.take()
+	if assert.Len(t, published, 1) {
+		assert.Contains(t, published[0], "ERROR: commit blink: verify sketch blink: sha256 mismatch")
+	}
+	assert.NotContains(t, status.uploads, "blink")
+	_, err := os.Stat(upload.file.Name())
+	assert.True(t, os.IsNotExist(err))
+
+	// the upload is gone
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "chunk", ID: "blink", Index: 0, Data: chunkData(binary[:4])}))
+	assert.Equal(t, []string{"$aws/things/dev/upload/chunk ERROR: chunk blink: upload not found, send begin first\n"}, client.take())
+}
+
+func TestUploadChunksAbort(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "begin", ID: "blink", Name: "blink", Size: 10, SHA256: "00"}))
+	client.take()
+	file := status.uploads["blink"].file.Name()
+
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "abort", ID: "blink"}))
+	assert.Equal(t, []string{"$aws/things/dev/upload/chunk INFO: upload blink aborted\n"}, client.take())
+	assert.NotContains(t, status.uploads, "blink")
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "status", ID: "blink"}))
+	assert.Equal(t, []string{"$aws/things/dev/upload/chunk ERROR: status blink: upload not found\n"}, client.take())
+}
+
+func TestUploadChunksLimits(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.config.SketchMaxSize = 1
+	defer func() {
+		for _, upload := range status.uploads {
+			upload.discard()
+		}
+	}()
+
+	tests := []struct {
+		payload ChunkPayload
+		err     string
+	}{
+		{ChunkPayload{Action: "begin", ID: "huge", Name: "huge", Size: 1<<63 - 1, SHA256: "00", ChunkSize: 1}, "is more than the maximum"},
+		{ChunkPayload{Action: "begin", ID: "big", Name: "big", Size: 1024*1024 + 1, SHA256: "00"}, "is more than the maximum"},
+		{ChunkPayload{Action: "begin", ID: "tiny", Name: "tiny", Size: 1024 * 1024, SHA256: "00", ChunkSize: 1}, "chunks are too many"},
+		{ChunkPayload{Action: "begin", ID: "wide", Name: "wide", Size: 10, SHA256: "00", ChunkSize: maxChunkSize + 1}, "chunk size must be"},
+	}
+	for _, test := range tests {
+		status.UploadChunkEvent(client, chunkMessage(test.payload))
+		published := client.take()
+		if assert.Len(t, published, 1, test.payload.ID) {
+			assert.Contains(t, published[0], test.err, test.payload.ID)
+		}
+	}
+	assert.Empty(t, status.uploads)
+
+	// without a maximum size the number of chunks still bounds an upload
+	status.config.SketchMaxSize = 0
+	status.UploadChunkEvent(client, chunkMessage(tests[0].payload))
+	assert.Contains(t, client.take()[0], "chunks are too many")
+
+	for i := 0; i < maxChunkedUploads; i++ {
+		status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "begin", ID: strconv.Itoa(i), Name: "blink", Size: 10, SHA256: "00"}))
+	}
+	client.take()
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "begin", ID: "one more", Name: "blink", Size: 10, SHA256: "00"}))
+	assert.Equal(t, []string{"$aws/things/dev/upload/chunk ERROR: begin one more: too many uploads in progress, the maximum is 4\n"}, client.take())
+}
+
+func TestUploadChunkAfterDiscard(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.UploadChunkEvent(client, chunkMessage(ChunkPayload{Action: "begin", ID: "blink", Name: "blink", Size: 4, SHA256: "00"}))
+	upload := status.uploads["blink"]
+
+	// a chunk racing with the abort finds the upload closed
+	upload.discard()
+	upload.Lock()
+	err := upload.write(0, []byte("1234"))
+	upload.Unlock()
+	assert.EqualError(t, err, "upload not found")
+}
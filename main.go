@@ -30,12 +30,10 @@ import (
 
 	docker "github.com/docker/docker/client"
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/fsnotify/fsnotify"
 	"github.com/hpcloud/tail"
 	"github.com/namsral/flag"
 	"github.com/nats-io/gnatsd/logger"
 	"github.com/nats-io/gnatsd/server"
-	"github.com/nats-io/go-nats"
 
 	"github.com/pkg/errors"
 )
@@ -60,6 +58,45 @@ type Config struct {
 	APIURL     string
 	updateURL  string
 	appName    string
+
+	SketchKeyring         string
+	RequireSignedSketches bool
+	SketchProbation       time.Duration
+	SketchVersions        int
+	SketchQuota           int64
+	SketchMaxSize         int64
+	DylibRegistries       string
+	DylibAllowLegacy      bool
+
+	SketchStopSignal  string
+	SketchStopTimeout time.Duration
+
+	ShellEnabled     bool
+	ShellCommand     string
+	ShellMaxSessions int
+	ShellIdleTimeout time.Duration
+	ShellIdentities  string
+
+	SerialRateLimit int
+
+	NatsHost   string
+	NatsPort   int
+	NatsSocket string
+	NatsAuth   bool
+	NatsToken  string
+	NatsUsers  string
+	// NatsSketchSerial grants serial ports to sketches, see parseSketchSerialPorts
+	NatsSketchSerial string
+
+	LocalMQTTHost string
+	LocalMQTTPort int
+
+	ShadowProperties string
+	Bridge           string
+
+	SketchesDropFolder         string
+	USBSketchFolder            string
+	RequireSignedLocalSketches bool
 }
 
 func (c Config) String() string {
@@ -86,6 +123,7 @@ func main() {
 	var doConfigure = flag.Bool("configure", false, "Connect and register on the cloud")
 	var listenFile = flag.String("listen", "", "Tail given file and report percentage")
 	var token = flag.String("token", "", "an authentication token")
+	var preseedLibs = flag.String("preseed-libs", "", "Install the given comma separated libraries from the dylib registries and exit")
 	flag.StringVar(&config.updateURL, "updateUrl", "http://downloads.arduino.cc/tools/feed/", "")
 	flag.StringVar(&config.appName, "appName", "arduino-connector", "")
 
@@ -98,9 +136,42 @@ func main() {
 	flag.StringVar(&config.AuthURL, "authurl", "https://hydra.arduino.cc", "Url of authentication server")
 	flag.StringVar(&config.APIURL, "apiurl", "https://api2.arduino.cc", "Url of api server")
 	flag.BoolVar(&debugMqtt, "debug-mqtt", false, "Output all received/sent messages")
+	flag.StringVar(&config.SketchKeyring, "sketch_keyring", "", "GPG keyring used to verify sketch signatures (defaults to the Arduino key)")
+	flag.BoolVar(&config.RequireSignedSketches, "require_signed_sketches", false, "Refuse to run sketches without a valid signature")
+	flag.IntVar(&config.SketchVersions, "sketch_versions", 3, "Number of binaries kept in the history of each sketch")
+	flag.Int64Var(&config.SketchMaxSize, "sketch_max_size", 256, "Maximum size in MB of a sketch uploaded in chunks (0 for no limit)")
+	flag.Int64Var(&config.SketchQuota, "sketch_quota", 0, "Maximum size in MB of the sketch folder, old versions are removed to respect it (0 for no limit)")
+	flag.StringVar(&config.DylibRegistries, "dylib_registries", defaultDylibRegistry, "Comma separated list of dylib registries (URLs or local files), in order of priority")
+	flag.BoolVar(&config.DylibAllowLegacy, "dylib_allow_legacy", false, "Also install the registry entries without checksums (only Provides), unverified")
+	flag.StringVar(&config.SketchStopSignal, "sketch_stop_signal", "SIGTERM", "Signal sent to the process group of a sketch to stop it")
+	flag.DurationVar(&config.SketchStopTimeout, "sketch_stop_timeout", 5*time.Second, "Time given to a sketch to exit before its process group is killed")
+	flag.BoolVar(&config.ShellEnabled, "shell_enabled", false, "Allow opening remote shell sessions through /shell/post")
+	flag.StringVar(&config.ShellCommand, "shell_command", "", "Command run in remote shell sessions (defaults to the login shell)")
+	flag.IntVar(&config.ShellMaxSessions, "shell_max_sessions", 2, "Maximum number of remote shell sessions open at the same time")
+	flag.StringVar(&config.ShellIdentities, "shell_identities", "", "Comma separated list of the identities allowed to use the remote shell")
+	flag.DurationVar(&config.ShellIdleTimeout, "shell_idle_timeout", 15*time.Minute, "Remote shell sessions without input or output for this long are closed")
+	flag.IntVar(&config.SerialRateLimit, "serial_rate_limit", 10, "Maximum number of messages per second sent for each serial port (0 for no limit)")
+	flag.StringVar(&config.NatsHost, "nats_host", "127.0.0.1", "Address the embedded NATS server listens on")
+	flag.IntVar(&config.NatsPort, "nats_port", 4222, "Port of the embedded NATS server (0 with nats_socket to use only the socket)")
+	flag.StringVar(&config.NatsSocket, "nats_socket", "", "Path of a unix socket where the embedded NATS server also accepts clients")
+	flag.BoolVar(&config.NatsAuth, "nats_auth", false, "Require the clients of the embedded NATS server to authenticate, sketches get their own credentials")
+	flag.StringVar(&config.NatsToken, "nats_token", "", "Token allowing a client to use every subject of the embedded NATS server (implies nats_auth)")
+	flag.StringVar(&config.NatsUsers, "nats_users", "", "JSON file with the users of the embedded NATS server and their permissions (implies nats_auth)")
+	flag.StringVar(&config.NatsSketchSerial, "nats_sketch_serial", "", "Comma separated <sketch id>=<port name> pairs, the serial ports each sketch can use through NATS with nats_auth")
+	flag.StringVar(&config.LocalMQTTHost, "local_mqtt_host", "127.0.0.1", "Address the embedded MQTT broker for the sketches listens on")
+	flag.IntVar(&config.LocalMQTTPort, "local_mqtt_port", 0, "Port of the embedded MQTT broker for the sketches, usually 1883 (0 to disable)")
+	flag.StringVar(&config.ShadowProperties, "shadow_properties", "", "JSON file with the interval, deadband and on change settings of the properties sent to the device shadow")
+	flag.StringVar(&config.Bridge, "bridge", "", "JSON file with the mappings between subjects of the embedded NATS server and MQTT topics")
+	flag.StringVar(&config.SketchesDropFolder, "sketches_drop_folder", "/tmp/sketches", "Sketches copied in this folder are installed and started")
+	flag.StringVar(&config.USBSketchFolder, "usb_sketch_folder", "", "Signed sketches found in this folder of a removable drive are installed and started (empty to disable)")
+	flag.BoolVar(&config.RequireSignedLocalSketches, "require_signed_local_sketches", false, "Refuse to run sketches from the drop folder or removable drives without a valid signature")
+	flag.DurationVar(&config.SketchProbation, "sketch_probation", 10*time.Second, "Roll back to the previous sketch if the new one exits within this time (0 to disable)")
 
 	flag.Parse()
 
+	_, err := parseStopSignal(config.SketchStopSignal)
+	check(err, "sketch_stop_signal")
+
 	// Create service and install
 	s, err := createService(config, *listenFile)
 	check(err, "CreateService")
@@ -116,6 +187,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *preseedLibs != "" {
+		err := preseedDylibs(strings.Split(*preseedLibs, ","), config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *doRegister {
 		register(config, *token)
 	}
@@ -165,25 +245,43 @@ func (p program) run() {
 	// Note, all_proxy will not be used by any HTTP/HTTPS connections.
 	p.exportProxyEnvVars()
 
-	// Start nats-server on localhost:4222
-	opts := server.Options{}
-	opts.Port = 4222
-	opts.Host = "127.0.0.1"
-	// Remove any host/ip that points to itself in Route
-	newroutes, err := server.RemoveSelfReference(opts.Cluster.Port, opts.Routes)
-	opts.Routes = newroutes
-	s := server.New(&opts)
-	configureNatsdLogger(s, &opts)
-	go s.Start()
+	// Start the embedded nats-server
+	natsServer, err := startNatsServer(p.Config)
+	check(err, "StartNATS")
 
-	if !s.ReadyForConnections(1 * time.Second) {
-		log.Fatal("NATS server not redy for connections!")
+	// Start the embedded MQTT broker, relaying to the nats-server
+	var broker *mqttBroker
+	if p.Config.LocalMQTTPort != 0 {
+		broker, err = startMQTTBroker(p.Config, natsServer)
+		check(err, "StartMQTTBroker")
 	}
 
 	// Create global status
 	status := NewStatus(p.Config.ID, nil, nil)
+	status.config = p.Config
+	status.nats = natsServer
+	status.mqttBroker = broker
+	if p.Config.ShadowProperties != "" {
+		status.Shadow.settings, err = loadShadowProperties(p.Config.ShadowProperties)
+		check(err, "shadow_properties")
+	}
+	if p.Config.Bridge != "" {
+		status.bridge, err = loadBridge(p.Config.Bridge, p.Config.ID)
+		check(err, "bridge")
+		natsServer.allowSketches(status.bridge.natsPermissions())
+	}
 	status.Update(p.Config)
 
+	// Start nats-client for local server, before connecting to MQTT to publish the events
+	nc, err := natsServer.connect()
+	check(err, "ConnectNATS")
+	status.natsClient = nc
+	nc.Subscribe("$arduino.cloud.*", natsCloudCB(status))
+	nc.Subscribe("$arduino.cloud.*.get", natsCloudGetCB(status))
+	status.subscribeEndpoints(nc)
+	status.subscribeAPI(nc)
+	status.bridgeFromNATS(nc)
+
 	// Setup MQTT connection
 	mqttClient, err := setupMQTTConnection("certificate.pem", "certificate.key", p.Config.ID, p.Config.URL, status)
 
@@ -207,16 +305,11 @@ func (p program) run() {
 		log.Println("Connection to Docker Daemon failed, containers features unavailable")
 	}
 	status.dockerClient = cli
+	go status.watchContainers()
+	go status.watchNetwork()
 
-	// Start nats-client for local server
-	nc, err := nats.Connect(nats.DefaultURL)
-	check(err, "ConnectNATS")
-	nc.Subscribe("$arduino.cloud.*", natsCloudCB(status))
-
-	// wipe the thing shadows
-	if status.mqttClient != nil {
-		mqttClient.Publish("$aws/things/"+p.Config.ID+"/shadow/delete", 1, false, "")
-	}
+	// the last known state of the shadow is fetched on connection
+	go status.watchShadow()
 
 	// start heartbeat
 	if status.mqttClient != nil {
@@ -247,9 +340,13 @@ func (p program) run() {
 		}
 	}
 
-	os.Mkdir("/tmp/sketches", 0700)
-
-	go addWatcherForManuallyAddedSketches("/tmp/sketches", sketchFolder, status)
+	if p.Config.SketchesDropFolder != "" {
+		os.MkdirAll(p.Config.SketchesDropFolder, 0700)
+		go addWatcherForManuallyAddedSketches(p.Config.SketchesDropFolder, status)
+	}
+	if p.Config.USBSketchFolder != "" {
+		go watchRemovableDrives(p.Config.USBSketchFolder, status)
+	}
 
 	autospawnSketchIfMatchesName("sketchLoadedThroughUSB", status)
 
@@ -269,8 +366,20 @@ func subscribeTopics(mqttClient mqtt.Client, id string, status *Status) {
 	}
 	subscribeTopic(mqttClient, id, "/status/post", status.StatusEvent)
 	subscribeTopic(mqttClient, id, "/upload/post", status.UploadEvent)
+	subscribeTopic(mqttClient, id, "/upload/chunk/post", status.UploadChunkEvent)
 	subscribeTopic(mqttClient, id, "/sketch/post", status.SketchEvent)
+	subscribeTopic(mqttClient, id, "/sketch/versions/post", status.SketchVersionsEvent)
+	subscribeTopic(mqttClient, id, "/sketch/call/post", status.SketchCallEvent)
+	subscribeTopic(mqttClient, id, "/sketch/display/post", status.SketchDisplayEvent)
+	subscribeTopic(mqttClient, id, "/sketch/telemetry/post", status.SketchTelemetryEvent)
 	subscribeTopic(mqttClient, id, "/update/post", status.UpdateEvent)
+	subscribeTopic(mqttClient, id, "/shell/post", status.ShellEvent)
+	subscribeTopic(mqttClient, id, "/serial/post", status.SerialEvent)
+	subscribeTopic(mqttClient, id, "/shadow/update/delta", status.ShadowDeltaEvent)
+	subscribeTopic(mqttClient, id, "/shadow/update/accepted", status.ShadowUpdateAcceptedEvent)
+	subscribeTopic(mqttClient, id, "/shadow/update/rejected", status.ShadowUpdateRejectedEvent)
+	subscribeTopic(mqttClient, id, "/shadow/get/accepted", status.ShadowGetAcceptedEvent)
+	subscribeTopic(mqttClient, id, "/shadow/get/rejected", status.ShadowGetRejectedEvent)
 	subscribeTopic(mqttClient, id, "/stats/post", status.StatsEvent)
 	subscribeTopic(mqttClient, id, "/wifi/post", status.WiFiEvent)
 	subscribeTopic(mqttClient, id, "/ethernet/post", status.EthEvent)
@@ -291,6 +400,11 @@ func subscribeTopics(mqttClient mqtt.Client, id string, status *Status) {
 	subscribeTopic(mqttClient, id, "/containers/images/post", status.ContainersListImagesEvent)
 	subscribeTopic(mqttClient, id, "/containers/action/post", status.ContainersActionEvent)
 	subscribeTopic(mqttClient, id, "/containers/rename/post", status.ContainersRenameEvent)
+
+	status.resubscribeShells(mqttClient)
+	status.resubscribeSerialPorts(mqttClient)
+	status.bridgeFromMQTT(mqttClient)
+	status.requestShadow(mqttClient)
 }
 
 func subscribeTopic(mqttClient mqtt.Client, id, topic string, handler mqtt.MessageHandler) {
@@ -312,10 +426,11 @@ func addFileToSketchDB(file os.FileInfo, status *Status) *SketchStatus {
 	}
 	fmt.Println("Getting sketch from " + id + " " + file.Name())
 	s := SketchStatus{
-		ID:     id,
-		PID:    0,
-		Name:   file.Name(),
-		Status: "STOPPED",
+		ID:      id,
+		PID:     0,
+		Name:    file.Name(),
+		Status:  SketchStopped,
+		Display: displaySettingsFor(id),
 	}
 	status.Set(id, &s)
 	status.Publish()
@@ -340,58 +455,6 @@ func copyFileAndRemoveOriginal(src string, dst string) error {
 	return nil
 }
 
-func addWatcherForManuallyAddedSketches(folderOrigin, folderDest string, status *Status) {
-	watcher, err := fsnotify.NewWatcher()
-	defer watcher.Close()
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event := <-watcher.Events:
-				log.Println("event:", event)
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					// give it some time to settle
-					time.Sleep(2 * time.Second)
-					//name := filepath.Base(strings.TrimSuffix(event.Name, filepath.Ext(event.Name)))
-					//filename := filepath.Join(folderDest, name)
-					filename := filepath.Join(folderDest, "sketchLoadedThroughUSB")
-
-					// stop already running sketch if it exists
-					if sketch, ok := status.Sketches["sketchLoadedThroughUSB"]; ok {
-						err = applyAction(sketch, "STOP", status)
-					}
-
-					err := os.Rename(event.Name, filename)
-					if err != nil {
-						// copy the file and remote the original
-						err = copyFileAndRemoveOriginal(event.Name, filename)
-						if err != nil {
-							// nevermind, break and do nothing
-							break
-						}
-					}
-					os.Chmod(filename, 0700)
-					log.Println("Moving new sketch to sketches folder")
-					fileInfo, err := os.Stat(filename)
-					if err != nil {
-						log.Println("Got error:" + err.Error())
-						break
-					}
-					s := addFileToSketchDB(fileInfo, status)
-					applyAction(s, "START", status)
-				}
-			case err := <-watcher.Errors:
-				log.Println("error:", err)
-			}
-		}
-	}()
-	err = watcher.Add(folderOrigin)
-	if err != nil {
-		log.Fatal(err)
-	}
-	<-done
-}
-
 func tailAndReport(listenFile string, status *Status) {
 	t, err := tail.TailFile(listenFile, tail.Config{Follow: true})
 	for err != nil {
@@ -442,6 +505,11 @@ func setupMQTTConnection(cert, key, id, url string, status *Status) (mqtt.Client
 	opts.SetAutoReconnect(true)
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
 		subscribeTopics(c, id, status)
+		status.Event("mqtt.connected", map[string]string{"url": url})
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Println("Connection to MQTT lost:", err)
+		status.Event("mqtt.disconnected", map[string]string{"url": url, "error": err.Error()})
 	})
 	opts.SetTLSConfig(&tls.Config{
 		Certificates: []tls.Certificate{cer},
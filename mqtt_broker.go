@@ -0,0 +1,346 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+)
+
+const (
+	// mqttConnectTimeout is the time given to a client to send its CONNECT
+	mqttConnectTimeout = 10 * time.Second
+	// mqttMaxPacketSize is the largest packet accepted from a client, as the
+	// largest payload of the NATS server
+	mqttMaxPacketSize = 1024 * 1024
+)
+
+// mqttBroker is the embedded MQTT broker for the sketches speaking MQTT. It has no
+// routing of its own: each of its clients is a client of the NATS server, with the
+// same credentials, and the topics are the subjects with / instead of .
+type mqttBroker struct {
+	listener net.Listener
+	url      string
+	nats     *natsServer
+}
+
+// startMQTTBroker starts the embedded MQTT broker in front of the NATS server
+func startMQTTBroker(config Config, ns *natsServer) (*mqttBroker, error) {
+	address := net.JoinHostPort(config.LocalMQTTHost, strconv.Itoa(config.LocalMQTTPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen on "+address)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	b := &mqttBroker{
+		listener: listener,
+		url:      "tcp://" + net.JoinHostPort(host, strconv.Itoa(addr.Port)),
+		nats:     ns,
+	}
+	go b.serve()
+	return b, nil
+}
+
+func (b *mqttBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+// sketchEnv returns the address of the broker for the sketches, they connect with
+// their NATS credentials
+func (b *mqttBroker) sketchEnv() []string {
+	if b == nil {
+		return nil
+	}
+	return []string{"MQTT_URL=" + b.url}
+}
+
+// mqttTopicToSubject turns a topic, or a filter, into the NATS subject it is bridged to
+func mqttTopicToSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			levels[i] = ">"
+		case "":
+			levels[i] = "_"
+		default:
+			levels[i] = subjectToken(level)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// natsSubjectToTopic turns a NATS subject into the topic of an MQTT message
+func natsSubjectToTopic(subject string) string {
+	return strings.Replace(subject, ".", "/", -1)
+}
+
+// mqttSession is a client of the broker and its connection to the NATS server
+type mqttSession struct {
+	conn          net.Conn
+	nc            *nats.Conn
+	writeMutex    sync.Mutex
+	subscriptions map[string]*nats.Subscription
+	// will is published if the client goes away without a DISCONNECT
+	will *packets.PublishPacket
+	// received are the ids of the QoS 2 messages published and not released yet,
+	// a redelivery of one of them is not published again
+	received map[uint16]bool
+}
+
+func (s *mqttSession) write(packet packets.ControlPacket) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return packet.Write(s.conn)
+}
+
+// handle serves a client from its CONNECT to its DISCONNECT
+func (b *mqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	packet, err := readMQTTPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if connack.ReturnCode = connect.Validate(); connack.ReturnCode != packets.Accepted {
+		connack.Write(conn)
+		return
+	}
+
+	session := &mqttSession{conn: conn, subscriptions: map[string]*nats.Subscription{}, received: map[uint16]bool{}}
+	options := []nats.Option{
+		nats.Name("mqtt " + connect.ClientIdentifier),
+		nats.NoReconnect(),
+		nats.ClosedHandler(func(*nats.Conn) { conn.Close() }),
+	}
+	if connect.UsernameFlag {
+		options = append(options, nats.UserInfo(connect.Username, string(connect.Password)))
+	}
+	session.nc, err = nats.Connect(b.nats.url, options...)
+	if err != nil {
+		connack.ReturnCode = packets.ErrRefusedServerUnavailable
+		if err == nats.ErrAuthorization {
+			connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		}
+		connack.Write(conn)
+		return
+	}
+	defer session.nc.Close()
+	if connect.WillFlag {
+		session.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		session.will.TopicName = connect.WillTopic
+		session.will.Payload = connect.WillMessage
+	}
+	if err := session.write(connack); err != nil {
+		return
+	}
+
+	var keepalive time.Duration
+	if connect.Keepalive > 0 {
+		keepalive = time.Duration(connect.Keepalive) * time.Second * 3 / 2
+	}
+	for {
+		if keepalive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepalive))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := readMQTTPacket(conn)
+		if err != nil {
+			break
+		}
+		if err := session.process(packet); err != nil {
+			if err != errMQTTDisconnect {
+				log.Println("MQTT client", connect.ClientIdentifier+":", err)
+			}
+			break
+		}
+	}
+
+	if session.will != nil {
+		session.publish(session.will)
+		session.nc.Flush()
+	}
+}
+
+var errMQTTDisconnect = errors.New("disconnect")
+
+// readMQTTPacket reads a packet like packets.ReadPacket, refusing the ones larger
+// than mqttMaxPacketSize before reading them
+func readMQTTPacket(r io.Reader) (packets.ControlPacket, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	header := packets.FixedHeader{
+		MessageType: b[0] >> 4,
+		Dup:         (b[0]>>3)&0x01 > 0,
+		Qos:         (b[0] >> 1) & 0x03,
+		Retain:      b[0]&0x01 > 0,
+	}
+	// the remaining length takes at most 4 bytes, 7 bits each
+	for i := uint(0); ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		header.RemainingLength |= int(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+	if header.RemainingLength > mqttMaxPacketSize {
+		return nil, errors.Errorf("packet of %d bytes exceeds the limit of %d bytes", header.RemainingLength, mqttMaxPacketSize)
+	}
+
+	packet := packets.NewControlPacketWithHeader(header)
+	if packet == nil {
+		return nil, errors.Errorf("unknown packet type %d", header.MessageType)
+	}
+	data := make([]byte, header.RemainingLength)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return packet, packet.Unpack(bytes.NewBuffer(data))
+}
+
+// process answers a packet of the client, an error closes the connection
+func (s *mqttSession) process(packet packets.ControlPacket) error {
+	switch p := packet.(type) {
+	case *packets.PublishPacket:
+		if strings.ContainsAny(p.TopicName, "+#") || p.TopicName == "" {
+			return errors.Errorf("invalid topic %q", p.TopicName)
+		}
+		switch p.Qos {
+		case 0:
+			s.publish(p)
+		case 1:
+			s.publish(p)
+			ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			ack.MessageID = p.MessageID
+			return s.write(ack)
+		case 2:
+			// published once, until the client releases the id
+			if !s.received[p.MessageID] {
+				s.received[p.MessageID] = true
+				s.publish(p)
+			}
+			rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+			rec.MessageID = p.MessageID
+			return s.write(rec)
+		default:
+			return errors.Errorf("invalid QoS %d", p.Qos)
+		}
+	case *packets.PubrelPacket:
+		delete(s.received, p.MessageID)
+		comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		comp.MessageID = p.MessageID
+		return s.write(comp)
+	case *packets.SubscribePacket:
+		suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		suback.MessageID = p.MessageID
+		for _, filter := range p.Topics {
+			suback.ReturnCodes = append(suback.ReturnCodes, s.subscribe(filter))
+		}
+		return s.write(suback)
+	case *packets.UnsubscribePacket:
+		for _, filter := range p.Topics {
+			if sub, ok := s.subscriptions[filter]; ok {
+				sub.Unsubscribe()
+				delete(s.subscriptions, filter)
+			}
+		}
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = p.MessageID
+		return s.write(unsuback)
+	case *packets.PingreqPacket:
+		return s.write(packets.NewControlPacket(packets.Pingresp))
+	case *packets.DisconnectPacket:
+		s.will = nil
+		return errMQTTDisconnect
+	case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+		// the messages to the client are sent with QoS 0
+	default:
+		return errors.Errorf("unexpected %s", packet.String())
+	}
+	return nil
+}
+
+// publish sends a message of the client on NATS, retained messages are not kept
+func (s *mqttSession) publish(p *packets.PublishPacket) {
+	s.nc.Publish(mqttTopicToSubject(p.TopicName), p.Payload)
+}
+
+// subscribe relays the messages of the NATS subject of a filter, it returns the
+// granted QoS, always 0, or 0x80 if the subscription is not allowed
+func (s *mqttSession) subscribe(filter string) byte {
+	if _, ok := s.subscriptions[filter]; ok {
+		return 0
+	}
+	previous := s.nc.LastError()
+	sub, err := s.nc.Subscribe(mqttTopicToSubject(filter), func(m *nats.Msg) {
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.TopicName = natsSubjectToTopic(m.Subject)
+		publish.Payload = m.Data
+		if err := s.write(publish); err != nil {
+			s.conn.Close()
+		}
+	})
+	if err != nil {
+		return 0x80
+	}
+	// a permissions violation comes back before the reply to the flush
+	if err := s.nc.Flush(); err != nil || (s.nc.LastError() != previous && s.nc.LastError() != nil &&
+		strings.Contains(s.nc.LastError().Error(), "subscription")) {
+		sub.Unsubscribe()
+		return 0x80
+	}
+	s.subscriptions[filter] = sub
+	return 0
+}
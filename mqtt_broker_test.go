@@ -0,0 +1,224 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMQTTBroker(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1, NatsAuth: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	broker, err := startMQTTBroker(Config{LocalMQTTHost: "127.0.0.1"}, ns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer broker.listener.Close()
+	connector, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer connector.Close()
+
+	env := map[string]string{}
+	for _, variable := range append(ns.sketchEnv("blink"), broker.sketchEnv()...) {
+		parts := strings.SplitN(variable, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	newClient := func(user, password string) mqtt.Client {
+		opts := mqtt.NewClientOptions().AddBroker(env["MQTT_URL"]).SetClientID("blink")
+		opts.SetUsername(user).SetPassword(password).SetAutoReconnect(false)
+		return mqtt.NewClient(opts)
+	}
+
+	// the NATS credentials are required
+	token := newClient("sketch-blink", "wrong").Connect()
+	token.Wait()
+	assert.Error(t, token.Error())
+
+	client := newClient(env["NATS_USER"], env["NATS_PASSWORD"])
+	if token := client.Connect(); !assert.True(t, token.Wait()) || !assert.NoError(t, token.Error()) {
+		return
+	}
+	defer client.Disconnect(100)
+
+	// the properties published by the sketch reach the connector
+	properties, _ := connector.SubscribeSync("$arduino.cloud.*")
+	connector.Flush()
+	client.Publish("$arduino/cloud/temp", 1, false, "21.5").Wait()
+	msg, err := properties.NextMsg(time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "$arduino.cloud.temp", msg.Subject)
+		assert.Equal(t, "21.5", string(msg.Data))
+	}
+
+	// and the sketch receives what it's allowed to
+	received := make(chan mqtt.Message, 10)
+	subscription := client.Subscribe("$arduino/cloud/+/set", 0, func(c mqtt.Client, m mqtt.Message) { received <- m })
+	subscription.Wait()
+	assert.Equal(t, byte(0), subscription.(*mqtt.SubscribeToken).Result()["$arduino/cloud/+/set"])
+	connector.Publish("$arduino.cloud.fan.set", []byte("true"))
+	select {
+	case m := <-received:
+		assert.Equal(t, "$arduino/cloud/fan/set", m.Topic())
+		assert.Equal(t, "true", string(m.Payload()))
+	case <-time.After(time.Second):
+		t.Error("message not relayed to the MQTT client")
+	}
+
+	denied := client.Subscribe("$arduino/connector/#", 0, func(c mqtt.Client, m mqtt.Message) {})
+	denied.Wait()
+	assert.Equal(t, byte(0x80), denied.(*mqtt.SubscribeToken).Result()["$arduino/connector/#"])
+}
+
+func TestMQTTTopicToSubject(t *testing.T) {
+	assert.Equal(t, "$arduino.cloud.*.set", mqttTopicToSubject("$arduino/cloud/+/set"))
+	assert.Equal(t, "_.sensors.room_1.>", mqttTopicToSubject("/sensors/room.1/#"))
+	assert.Equal(t, "$arduino/telemetry/blink/temp", natsSubjectToTopic("$arduino.telemetry.blink.temp"))
+}
+
+func TestMQTTBrokerQoS2(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	broker, err := startMQTTBroker(Config{LocalMQTTHost: "127.0.0.1"}, ns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer broker.listener.Close()
+	connector, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer connector.Close()
+	properties, _ := connector.SubscribeSync("$arduino.cloud.*")
+	connector.Flush()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(broker.url, "tcp://"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", 4
+	connect.ClientIdentifier, connect.CleanSession = "blink", true
+	connect.Write(conn)
+	if packet, err := readMQTTPacket(conn); assert.NoError(t, err) {
+		assert.IsType(t, &packets.ConnackPacket{}, packet)
+	}
+
+	publish := func(id uint16, dup bool, payload string) {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.Qos, p.Dup, p.MessageID = 2, dup, id
+		p.TopicName, p.Payload = "$arduino/cloud/temp", []byte(payload)
+		p.Write(conn)
+		packet, err := readMQTTPacket(conn)
+		if assert.NoError(t, err) && assert.IsType(t, &packets.PubrecPacket{}, packet) {
+			assert.Equal(t, id, packet.(*packets.PubrecPacket).MessageID)
+		}
+	}
+	release := func(id uint16) {
+		p := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		p.MessageID = id
+		p.Write(conn)
+		packet, err := readMQTTPacket(conn)
+		if assert.NoError(t, err) && assert.IsType(t, &packets.PubcompPacket{}, packet) {
+			assert.Equal(t, id, packet.(*packets.PubcompPacket).MessageID)
+		}
+	}
+	relayed := func() []string {
+		var payloads []string
+		for {
+			msg, err := properties.NextMsg(200 * time.Millisecond)
+			if err != nil {
+				return payloads
+			}
+			payloads = append(payloads, string(msg.Data))
+		}
+	}
+
+	// the redelivery of a message not released yet is acknowledged but not relayed
+	publish(1, false, "21.5")
+	publish(1, true, "21.5")
+	publish(2, false, "22")
+	assert.Equal(t, []string{"21.5", "22"}, relayed())
+	release(1)
+	publish(2, true, "22")
+	release(2)
+	assert.Empty(t, relayed())
+
+	// the id can be used again once released
+	publish(1, false, "23")
+	release(1)
+	assert.Equal(t, []string{"23"}, relayed())
+
+	// a packet larger than the limit closes the connection before it's sent
+	conn.Write([]byte{0x30, 0x80, 0x80, 0x80, 0x01})
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	ping := new(bytes.Buffer)
+	packets.NewControlPacket(packets.Pingreq).Write(ping)
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName, publish.Payload = "a/b", make([]byte, mqttMaxPacketSize-5)
+	largest := new(bytes.Buffer)
+	publish.Write(largest)
+	publish.Payload = make([]byte, mqttMaxPacketSize)
+	tooLarge := new(bytes.Buffer)
+	publish.Write(tooLarge)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"ping", ping.Bytes(), ""},
+		{"largest publish", largest.Bytes(), ""},
+		{"publish too large", tooLarge.Bytes(), "exceeds the limit"},
+		{"length too large", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, "exceeds the limit"},
+		{"malformed length", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, "malformed remaining length"},
+		{"unknown type", []byte{0xf0, 0x00}, "unknown packet type"},
+		{"truncated", []byte{0x30, 0x0a, 0x00}, "EOF"},
+	}
+	for _, test := range tests {
+		packet, err := readMQTTPacket(bytes.NewReader(test.data))
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+			assert.NotNil(t, packet, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+}
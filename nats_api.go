@@ -0,0 +1,103 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+)
+
+// the subjects of the request/reply API of the connector on the local NATS server
+const (
+	natsAPIStatus       = "$arduino.connector.status"
+	natsAPIStats        = "$arduino.connector.stats"
+	natsAPISketch       = "$arduino.connector.sketch.*"
+	natsAPIContainersPs = "$arduino.connector.containers.ps"
+)
+
+// natsAPIHandler answers a request with a value to marshal, or an error
+type natsAPIHandler func(m *nats.Msg) (interface{}, error)
+
+// subscribeAPI answers the requests of the local apps and sketches, with the same
+// logic of the MQTT handlers
+func (s *Status) subscribeAPI(nc *nats.Conn) {
+	nc.Subscribe(natsAPIStatus, s.natsAPICB(func(m *nats.Msg) (interface{}, error) {
+		data, err := s.JSON()
+		return json.RawMessage(data), err
+	}))
+	nc.Subscribe(natsAPIStats, s.natsAPICB(func(m *nats.Msg) (interface{}, error) {
+		stats, errs := systemStats()
+		if stats.Memory == nil && stats.Disk == nil && stats.Network == nil && len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return stats, nil
+	}))
+	nc.Subscribe(natsAPISketch, s.natsAPICB(s.natsSketchAction))
+	nc.Subscribe(natsAPIContainersPs, s.natsAPICB(func(m *nats.Msg) (interface{}, error) {
+		var payload PsPayload
+		if err := unmarshalRequest(m.Data, &payload); err != nil {
+			return nil, err
+		}
+		return s.containersPs(payload)
+	}))
+}
+
+// natsSketchAction performs the action in the subject, $arduino.connector.sketch.<action>,
+// on the sketch in the request: {"id": "...", "version": "..."}
+func (s *Status) natsSketchAction(m *nats.Msg) (interface{}, error) {
+	var payload SketchActionPayload
+	if err := unmarshalRequest(m.Data, &payload); err != nil {
+		return nil, err
+	}
+	payload.Action = strings.ToUpper(strings.TrimPrefix(m.Subject, "$arduino.connector.sketch."))
+	return s.performSketchAction(payload)
+}
+
+// unmarshalRequest decodes the JSON payload of a request, an empty one is allowed
+func unmarshalRequest(data []byte, v interface{}) error {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", data)
+	}
+	return nil
+}
+
+// natsAPICB replies with the JSON result of the handler, or ERROR: <reason>
+func (s *Status) natsAPICB(handler natsAPIHandler) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		if m.Reply == "" {
+			return
+		}
+		result, err := handler(m)
+		var data []byte
+		if err == nil {
+			data, err = json.Marshal(result)
+		}
+		if err != nil {
+			s.natsClient.Publish(m.Reply, []byte("ERROR: "+err.Error()))
+			return
+		}
+		s.natsClient.Publish(m.Reply, data)
+	}
+}
@@ -0,0 +1,72 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsAPI(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	nc, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+
+	status := NewStatus("dev", nil, nil)
+	status.natsClient = nc
+	status.Sketches["blink"] = &SketchStatus{ID: "blink", Name: "blink", Status: SketchStopped}
+	status.subscribeAPI(nc)
+
+	reply, err := nc.Request("$arduino.connector.status", nil, time.Second)
+	if assert.NoError(t, err) {
+		var got struct {
+			Sketches map[string]SketchStatus `json:"sketches"`
+		}
+		assert.NoError(t, json.Unmarshal(reply.Data, &got))
+		assert.Equal(t, SketchStopped, got.Sketches["blink"].Status)
+	}
+
+	// the same errors as the MQTT handlers, as reply
+	reply, err = nc.Request("$arduino.connector.sketch.pause", []byte(`{"id": "blink"}`), time.Second)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(reply.Data), "ERROR: applying PAUSE to blink")
+	}
+	reply, err = nc.Request("$arduino.connector.sketch.start", []byte(`{"id": "missing"}`), time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ERROR: sketch missing not found", string(reply.Data))
+	}
+	reply, err = nc.Request("$arduino.connector.sketch.start", []byte(`{broken`), time.Second)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(reply.Data), "ERROR: unmarshal")
+	}
+	reply, err = nc.Request("$arduino.connector.containers.ps", nil, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ERROR: docker is not available on this device", string(reply.Data))
+	}
+}
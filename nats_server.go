@@ -0,0 +1,388 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// connectorNatsUser is the user of the connector itself, allowed on every subject
+const connectorNatsUser = "arduino-connector"
+
+const (
+	// connectorInboxPrefix is where the connector receives the replies to its requests,
+	// the only inboxes the sketches can publish on
+	connectorInboxPrefix = "_INBOX.connector"
+	// tokenInboxPrefix is where the clients using the token receive their replies
+	tokenInboxPrefix = "_INBOX.token"
+)
+
+// sketchInboxPrefix is where a sketch receives the replies to its requests, the
+// inboxes of the other clients are out of its reach
+func sketchInboxPrefix(id string) string {
+	return "_INBOX.sketch-" + subjectToken(id)
+}
+
+// clientNatsPermissions are the subjects of every sketch and of the clients using the
+// token, which receive their replies under inboxPrefix
+func clientNatsPermissions(inboxPrefix string) *server.Permissions {
+	return &server.Permissions{
+		Publish: []string{
+			"$arduino.cloud.*",
+			"$arduino.cloud.*.get",
+			natsAPIStatus,
+			natsAPIStats,
+			connectorInboxPrefix + ".>",
+		},
+		Subscribe: []string{
+			"$arduino.cloud.*.set",
+			"$arduino.telemetry.>",
+			"$arduino.events.>",
+			inboxPrefix + ".>",
+		},
+	}
+}
+
+// sketchNatsPermissions are the subjects a sketch can use with its credentials:
+// its own endpoints and inboxes, and the serial ports granted to it
+func sketchNatsPermissions(id string, serialPorts []string) *server.Permissions {
+	permissions := clientNatsPermissions(sketchInboxPrefix(id))
+	permissions.Publish = append(permissions.Publish, endpointsRegistrationSubject(subjectToken(id), "*"))
+	permissions.Subscribe = append(permissions.Subscribe, "$arduino.endpoints."+subjectToken(id)+".>")
+	for _, port := range serialPorts {
+		permissions.Publish = append(permissions.Publish, serialSubject(port)+".write")
+		permissions.Subscribe = append(permissions.Subscribe, serialSubject(port))
+	}
+	return permissions
+}
+
+// parseSketchSerialPorts reads the serial ports granted to the sketches, as comma
+// separated <sketch id>=<port name> pairs
+func parseSketchSerialPorts(grants string) (map[string][]string, error) {
+	ports := map[string][]string{}
+	for _, grant := range strings.Split(grants, ",") {
+		grant = strings.TrimSpace(grant)
+		if grant == "" {
+			continue
+		}
+		parts := strings.SplitN(grant, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.Errorf("invalid serial port grant %q, expected <sketch id>=<port name>", grant)
+		}
+		id := strings.TrimSpace(parts[0])
+		ports[id] = append(ports[id], strings.TrimSpace(parts[1]))
+	}
+	return ports, nil
+}
+
+// natsAuthenticator checks the clients of the embedded NATS server: the token, the
+// users of the users file, the connector and the sketches, each with its permissions
+type natsAuthenticator struct {
+	token string
+	mutex sync.Mutex
+	users map[string]*server.User
+	// tokenPermissions are the ones of the clients using the token, guarded by mutex
+	tokenPermissions *server.Permissions
+}
+
+// Check implements server.Authentication
+func (a *natsAuthenticator) Check(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+	if a.token != "" && opts.Authorization != "" {
+		if subtle.ConstantTimeCompare([]byte(opts.Authorization), []byte(a.token)) != 1 {
+			return false
+		}
+		a.mutex.Lock()
+		permissions := a.tokenPermissions
+		a.mutex.Unlock()
+		c.RegisterUser(&server.User{Permissions: permissions})
+		return true
+	}
+
+	a.mutex.Lock()
+	user, ok := a.users[opts.Username]
+	a.mutex.Unlock()
+	if !ok || !passwordMatches(user.Password, opts.Password) {
+		return false
+	}
+	c.RegisterUser(user)
+	return true
+}
+
+// passwordMatches compares a password with a clear text or bcrypt one
+func passwordMatches(expected, password string) bool {
+	if strings.HasPrefix(expected, "$2a$") || strings.HasPrefix(expected, "$2b$") {
+		return bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// register adds or replaces a user
+func (a *natsAuthenticator) register(user *server.User) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.users[user.Username] = user
+}
+
+// revoke removes a user, its open connections are not closed
+func (a *natsAuthenticator) revoke(username string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.users, username)
+}
+
+// loadNatsUsers reads a JSON list of users, as
+// [{"user": "...", "password": "...", "permissions": {"publish": [...], "subscribe": [...]}}]
+func loadNatsUsers(path string) ([]*server.User, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read nats users")
+	}
+	var users []*server.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %s", path)
+	}
+	for _, user := range users {
+		if user.Username == "" || user.Username == connectorNatsUser || strings.HasPrefix(user.Username, "sketch-") {
+			return nil, errors.Errorf("invalid nats user name %q in %s", user.Username, path)
+		}
+	}
+	return users, nil
+}
+
+func randomSecret() string {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+// natsServer is the embedded NATS server with the settings its clients need
+type natsServer struct {
+	server *server.Server
+	// url is where the clients connect through TCP
+	url    string
+	socket string
+	auth   *natsAuthenticator
+	// user and password of the connector, if authentication is required
+	user     string
+	password string
+	// sketchPublish and sketchSubscribe are allowed to the sketches on top of their own subjects
+	sketchPublish   []string
+	sketchSubscribe []string
+	// sketchSerial are the serial ports granted to each sketch
+	sketchSerial map[string][]string
+}
+
+// startNatsServer starts the embedded NATS server as configured
+func startNatsServer(config Config) (*natsServer, error) {
+	opts := server.Options{}
+	opts.Host = config.NatsHost
+	opts.Port = config.NatsPort
+	if config.NatsSocket != "" && config.NatsPort == 0 {
+		// only the socket is meant to be used, the TCP port only serves as its backend
+		opts.Host = "127.0.0.1"
+		opts.Port = server.RANDOM_PORT
+	}
+
+	sketchSerial, err := parseSketchSerialPorts(config.NatsSketchSerial)
+	if err != nil {
+		return nil, err
+	}
+	ns := &natsServer{socket: config.NatsSocket, sketchSerial: sketchSerial}
+	// the TCP port behind the socket is open to any local user, it can't be left
+	// without authentication
+	socketOnly := config.NatsSocket != "" && config.NatsPort == 0
+	if config.NatsAuth || config.NatsToken != "" || config.NatsUsers != "" || socketOnly {
+		ns.auth = &natsAuthenticator{
+			token:            config.NatsToken,
+			users:            map[string]*server.User{},
+			tokenPermissions: clientNatsPermissions(tokenInboxPrefix),
+		}
+		if config.NatsUsers != "" {
+			users, err := loadNatsUsers(config.NatsUsers)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				ns.auth.register(user)
+			}
+		}
+		ns.user = connectorNatsUser
+		ns.password = randomSecret()
+		ns.auth.register(&server.User{Username: ns.user, Password: ns.password})
+		opts.CustomClientAuthentication = ns.auth
+	}
+
+	// Remove any host/ip that points to itself in Route
+	newroutes, err := server.RemoveSelfReference(opts.Cluster.Port, opts.Routes)
+	if err != nil {
+		return nil, err
+	}
+	opts.Routes = newroutes
+	ns.server = server.New(&opts)
+	configureNatsdLogger(ns.server, &opts)
+	go ns.server.Start()
+
+	if !ns.server.ReadyForConnections(5 * time.Second) {
+		return nil, errors.New("NATS server not ready for connections")
+	}
+	addr, ok := ns.server.Addr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("NATS server is not listening")
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	ns.url = "nats://" + net.JoinHostPort(host, strconv.Itoa(addr.Port))
+
+	if ns.socket != "" {
+		if err := ns.listenSocket(); err != nil {
+			ns.server.Shutdown()
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// listenSocket accepts the clients on the unix socket and relays them to the TCP listener
+func (ns *natsServer) listenSocket() error {
+	os.Remove(ns.socket)
+	listener, err := net.Listen("unix", ns.socket)
+	if err != nil {
+		return errors.Wrap(err, "listen on "+ns.socket)
+	}
+	if err := os.Chmod(ns.socket, 0660); err != nil {
+		listener.Close()
+		return errors.Wrap(err, "chmod "+ns.socket)
+	}
+	backend := strings.TrimPrefix(ns.url, "nats://")
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				conn, err := net.Dial("tcp", backend)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				go func() {
+					io.Copy(conn, client)
+					conn.Close()
+				}()
+				io.Copy(client, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// natsRequest sends a request and waits for its reply on an inbox of the connector,
+// the sketches can't publish on the default ones
+func natsRequest(nc *nats.Conn, subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
+	inbox := connectorInboxPrefix + "." + strings.TrimPrefix(nats.NewInbox(), nats.InboxPrefix)
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := nc.PublishRequest(subject, inbox, data); err != nil {
+		return nil, err
+	}
+	return sub.NextMsg(timeout)
+}
+
+// connect opens the connection of the connector
+func (ns *natsServer) connect() (*nats.Conn, error) {
+	var options []nats.Option
+	if ns.auth != nil {
+		options = append(options, nats.UserInfo(ns.user, ns.password))
+	}
+	return nats.Connect(ns.url, options...)
+}
+
+// sketchEnv returns the NATS settings of a sketch, with new credentials when
+// authentication is required
+func (ns *natsServer) sketchEnv(id string) []string {
+	if ns == nil {
+		return nil
+	}
+	env := []string{"NATS_URL=" + ns.url, "NATS_INBOX_PREFIX=" + sketchInboxPrefix(id)}
+	if ns.socket != "" {
+		env = append(env, "NATS_SOCKET="+ns.socket)
+	}
+	if ns.auth != nil {
+		user := &server.User{
+			Username:    "sketch-" + subjectToken(id),
+			Password:    randomSecret(),
+			Permissions: sketchNatsPermissions(id, ns.sketchSerial[id]),
+		}
+		user.Permissions.Publish = append(user.Permissions.Publish, ns.sketchPublish...)
+		user.Permissions.Subscribe = append(user.Permissions.Subscribe, ns.sketchSubscribe...)
+		ns.auth.register(user)
+		env = append(env, "NATS_USER="+user.Username, "NATS_PASSWORD="+user.Password)
+	}
+	return env
+}
+
+// allowSketches lets the sketches started from now on use more subjects
+func (ns *natsServer) allowSketches(publish, subscribe []string) {
+	ns.sketchPublish = append(ns.sketchPublish, publish...)
+	ns.sketchSubscribe = append(ns.sketchSubscribe, subscribe...)
+	if ns.auth == nil {
+		return
+	}
+	// and the clients using the token, the permissions of those connected are not changed
+	ns.auth.mutex.Lock()
+	defer ns.auth.mutex.Unlock()
+	permissions := clientNatsPermissions(tokenInboxPrefix)
+	permissions.Publish = append(permissions.Publish, ns.sketchPublish...)
+	permissions.Subscribe = append(permissions.Subscribe, ns.sketchSubscribe...)
+	ns.auth.tokenPermissions = permissions
+}
+
+// revokeSketch removes the credentials of a sketch
+func (ns *natsServer) revokeSketch(id string) {
+	if ns == nil || ns.auth == nil {
+		return
+	}
+	ns.auth.revoke("sketch-" + subjectToken(id))
+}
@@ -0,0 +1,272 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsServerAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	users := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(users, []byte(`[{"user": "dashboard", "password": "secret",
+		"permissions": {"publish": ["$arduino.cloud.*"], "subscribe": ["_INBOX.>"]}}]`), 0600)
+	socket := filepath.Join(dir, "nats.sock")
+
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsSocket: socket, NatsToken: "letmein", NatsUsers: users})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+
+	_, err = nats.Connect(ns.url)
+	assert.Error(t, err)
+	_, err = nats.Connect(ns.url, nats.UserInfo("dashboard", "wrong"))
+	assert.Error(t, err)
+
+	connector, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer connector.Close()
+	withToken, err := nats.Connect(ns.url, nats.Token("letmein"))
+	if assert.NoError(t, err) {
+		withToken.Close()
+	}
+	dashboard, err := nats.Connect(ns.url, nats.UserInfo("dashboard", "secret"))
+	if assert.NoError(t, err) {
+		dashboard.Close()
+	}
+
+	// sketches get their own credentials, until they are revoked
+	env := map[string]string{}
+	for _, variable := range ns.sketchEnv("blink") {
+		parts := strings.SplitN(variable, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	assert.Equal(t, socket, env["NATS_SOCKET"])
+	sketch, err := nats.Connect(env["NATS_URL"], nats.UserInfo(env["NATS_USER"], env["NATS_PASSWORD"]))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sketch.Close()
+
+	// the connector receives what the sketch is allowed to publish, and nothing else
+	received, _ := connector.SubscribeSync("$arduino.>")
+	connector.Flush()
+	sketch.Publish("$arduino.connector.sketch.delete", []byte(`{"id": "blink"}`))
+	sketch.Publish("$arduino.sketch.other.endpoints.register", []byte(`{"name": "stop"}`))
+	sketch.Publish("$arduino.sketch.blink.endpoints.register", []byte(`{"name": "stop"}`))
+	sketch.Publish("$arduino.cloud.temp", []byte("21"))
+	sketch.Flush()
+	for _, subject := range []string{"$arduino.sketch.blink.endpoints.register", "$arduino.cloud.temp"} {
+		msg, err := received.NextMsg(time.Second)
+		if assert.NoError(t, err) {
+			assert.Equal(t, subject, msg.Subject)
+		}
+	}
+
+	// the replies to the others are out of its reach, it gets its own
+	others, _ := sketch.SubscribeSync("_INBOX.>")
+	sketch.Flush()
+	connector.Publish("_INBOX.dashboard.1", []byte("secret"))
+	connector.Flush()
+	_, err = others.NextMsg(200 * time.Millisecond)
+	assert.Error(t, err)
+	replier, _ := connector.Subscribe("$arduino.connector.status", func(m *nats.Msg) {
+		connector.Publish(m.Reply, []byte("{}"))
+	})
+	connector.Flush()
+	inbox, _ := sketch.SubscribeSync(env["NATS_INBOX_PREFIX"] + ".1")
+	sketch.PublishRequest("$arduino.connector.status", env["NATS_INBOX_PREFIX"]+".1", nil)
+	if reply, err := inbox.NextMsg(time.Second); assert.NoError(t, err) {
+		assert.Equal(t, "{}", string(reply.Data))
+	}
+	replier.Unsubscribe()
+
+	ns.revokeSketch("blink")
+	_, err = nats.Connect(env["NATS_URL"], nats.UserInfo(env["NATS_USER"], env["NATS_PASSWORD"]))
+	assert.Error(t, err)
+
+	// the socket leads to the same server
+	viaSocket, err := nats.Connect("nats://socket", nats.Token("letmein"),
+		nats.SetCustomDialer(socketDialer(socket)))
+	if assert.NoError(t, err) {
+		viaSocket.Close()
+	}
+}
+
+type socketDialer string
+
+func (d socketDialer) Dial(network, address string) (net.Conn, error) {
+	return net.Dial("unix", string(d))
+}
+
+func TestNatsSocketOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nats")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "nats.sock")
+
+	// the TCP port behind the socket requires authentication
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsSocket: socket})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+	_, err = nats.Connect(ns.url)
+	assert.Error(t, err)
+	_, err = nats.Connect("nats://socket", nats.SetCustomDialer(socketDialer(socket)))
+	assert.Error(t, err)
+	connector, err := ns.connect()
+	if assert.NoError(t, err) {
+		connector.Close()
+	}
+}
+
+// delivered tells if a message published by from on subject reaches to
+func delivered(from, to *nats.Conn, subject string) bool {
+	sub, err := to.SubscribeSync(subject)
+	if err != nil {
+		return false
+	}
+	defer sub.Unsubscribe()
+	to.Flush()
+	from.Publish(subject, []byte("hello"))
+	from.Flush()
+	_, err = sub.NextMsg(200 * time.Millisecond)
+	return err == nil
+}
+
+func TestNatsClientPermissions(t *testing.T) {
+	ns, err := startNatsServer(Config{NatsHost: "127.0.0.1", NatsPort: -1, NatsToken: "letmein",
+		NatsSketchSerial: "blink=ttyACM0, blink=ttyUSB0,fade=ttyS0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ns.server.Shutdown()
+
+	connector, err := ns.connect()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer connector.Close()
+	connect := func(id string) *nats.Conn {
+		env := map[string]string{}
+		for _, variable := range ns.sketchEnv(id) {
+			parts := strings.SplitN(variable, "=", 2)
+			env[parts[0]] = parts[1]
+		}
+		nc, err := nats.Connect(ns.url, nats.UserInfo(env["NATS_USER"], env["NATS_PASSWORD"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nc
+	}
+	blink, fade := connect("blink"), connect("fade")
+	defer blink.Close()
+	defer fade.Close()
+	withToken, err := nats.Connect(ns.url, nats.Token("letmein"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer withToken.Close()
+
+	tests := []struct {
+		name     string
+		from, to *nats.Conn
+		subject  string
+		allowed  bool
+	}{
+		{"serial port granted", connector, blink, "$arduino.serial.ttyACM0", true},
+		{"another serial port granted", connector, blink, "$arduino.serial.ttyUSB0", true},
+		{"write to a serial port granted", blink, connector, "$arduino.serial.ttyACM0.write", true},
+		{"serial port of another sketch", connector, blink, "$arduino.serial.ttyS0", false},
+		{"write to the serial port of another sketch", blink, connector, "$arduino.serial.ttyS0.write", false},
+		{"serial port granted to the other sketch", connector, fade, "$arduino.serial.ttyS0", true},
+		{"reply to the connector", blink, connector, connectorInboxPrefix + ".abc", true},
+		{"reply to another client", blink, connector, "_INBOX.dashboard.1", false},
+		{"reply to the other sketch", blink, connector, sketchInboxPrefix("fade") + ".1", false},
+		{"own inbox", connector, blink, sketchInboxPrefix("blink") + ".1", true},
+		{"inbox of the other sketch", connector, blink, sketchInboxPrefix("fade") + ".1", false},
+		{"token cloud property", withToken, connector, "$arduino.cloud.temp", true},
+		{"token inbox", connector, withToken, tokenInboxPrefix + ".1", true},
+		{"token reply to the connector", withToken, connector, connectorInboxPrefix + ".abc", true},
+		{"token inbox of a sketch", connector, withToken, sketchInboxPrefix("blink") + ".1", false},
+		{"token endpoints of a sketch", connector, withToken, "$arduino.endpoints.blink.stop", false},
+		{"token endpoint registration", withToken, connector, "$arduino.sketch.blink.endpoints.register", false},
+		{"token serial port", connector, withToken, "$arduino.serial.ttyACM0", false},
+		{"token connector subjects", withToken, connector, "$arduino.connector.sketch.delete", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.allowed, delivered(test.from, test.to, test.subject), test.name)
+	}
+
+	// the connector gets the replies to its requests on its inboxes
+	blink.Subscribe("$arduino.endpoints.blink.stop", func(m *nats.Msg) {
+		assert.True(t, strings.HasPrefix(m.Reply, connectorInboxPrefix+"."), m.Reply)
+		blink.Publish(m.Reply, []byte("stopped"))
+	})
+	blink.Flush()
+	reply, err := natsRequest(connector, "$arduino.endpoints.blink.stop", nil, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "stopped", string(reply.Data))
+	}
+	_, err = natsRequest(connector, "$arduino.endpoints.fade.stop", nil, 100*time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+}
+
+func TestParseSketchSerialPorts(t *testing.T) {
+	tests := []struct {
+		grants string
+		ports  map[string][]string
+		err    string
+	}{
+		{"", map[string][]string{}, ""},
+		{"blink=ttyACM0", map[string][]string{"blink": {"ttyACM0"}}, ""},
+		{" blink = ttyACM0 , blink=ttyUSB0,fade=ttyS0,", map[string][]string{"blink": {"ttyACM0", "ttyUSB0"}, "fade": {"ttyS0"}}, ""},
+		{"blink", nil, "invalid serial port grant"},
+		{"=ttyACM0", nil, "invalid serial port grant"},
+		{"blink=", nil, "invalid serial port grant"},
+	}
+	for _, test := range tests {
+		ports, err := parseSketchSerialPorts(test.grants)
+		if test.err == "" {
+			assert.NoError(t, err, test.grants)
+			assert.Equal(t, test.ports, ports, test.grants)
+		} else if assert.Error(t, err, test.grants) {
+			assert.Contains(t, err.Error(), test.err, test.grants)
+		}
+	}
+}
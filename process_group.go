@@ -0,0 +1,85 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// pPID is the idtype of waitid selecting a single process
+const pPID = 1
+
+// processGroup is the process group of a leader started with its own session.
+// The id of the group is the pid of the leader: it can't be reused as long as the
+// leader isn't reaped, so the group is only signaled until then.
+type processGroup struct {
+	pid    int
+	mutex  sync.Mutex
+	reaped bool
+}
+
+func newProcessGroup(pid int) *processGroup {
+	return &processGroup{pid: pid}
+}
+
+// kill sends a signal to the group, nothing once the leader is reaped
+func (g *processGroup) kill(signal syscall.Signal) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.reaped {
+		return nil
+	}
+	return syscall.Kill(-g.pid, signal)
+}
+
+// wait waits for the leader to exit and calls beforeReap, which can still signal
+// what is left of the group, before reaping it
+func (g *processGroup) wait(cmd *exec.Cmd, beforeReap func()) error {
+	waitExited(g.pid)
+	if beforeReap != nil {
+		beforeReap()
+	}
+	g.mutex.Lock()
+	g.reaped = true
+	g.mutex.Unlock()
+	return cmd.Wait()
+}
+
+// waitExited blocks until a child exits, leaving it a zombie to be reaped
+func waitExited(pid int) error {
+	// siginfo_t, filled by waitid
+	var info [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(unix.SYS_WAITID, pPID, uintptr(pid), uintptr(unsafe.Pointer(&info[0])),
+			unix.WEXITED|unix.WNOWAIT, 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		default:
+			return errno
+		}
+	}
+}
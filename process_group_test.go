@@ -0,0 +1,71 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// processAlive tells if a process is running, zombies are dead
+func processAlive(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+func TestProcessGroup(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $!; exit 0")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, _ := cmd.StdoutPipe()
+	if !assert.NoError(t, cmd.Start()) {
+		return
+	}
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	orphan, err := strconv.Atoi(strings.TrimSpace(line))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the orphan left by the leader is killed before the leader is reaped
+	group := newProcessGroup(cmd.Process.Pid)
+	group.wait(cmd, func() {
+		assert.True(t, processAlive(orphan))
+		assert.NoError(t, group.kill(syscall.SIGKILL))
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(orphan) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, processAlive(orphan))
+
+	// and nothing is signaled afterwards, the id may belong to someone else
+	assert.NoError(t, group.kill(syscall.SIGKILL))
+}
@@ -0,0 +1,513 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+)
+
+const (
+	// shadowSetTimeout is the time given to a sketch to acknowledge a property change
+	shadowSetTimeout = 5 * time.Second
+	// shadowResponseTimeout is the time after which an unanswered get or update is sent again
+	shadowResponseTimeout = 10 * time.Second
+)
+
+// ShadowDelta is the difference between the desired and the reported state of the device shadow
+type ShadowDelta struct {
+	Version int64                      `json:"version"`
+	State   map[string]json.RawMessage `json:"state"`
+}
+
+// ShadowDocument is the device shadow, as returned by shadow/get/accepted
+type ShadowDocument struct {
+	Version int64 `json:"version"`
+	State   struct {
+		Desired  map[string]json.RawMessage `json:"desired"`
+		Reported map[string]json.RawMessage `json:"reported"`
+		Delta    map[string]json.RawMessage `json:"delta"`
+	} `json:"state"`
+	ClientToken string `json:"clientToken"`
+}
+
+// ShadowError is the payload of shadow/get/rejected and shadow/update/rejected
+type ShadowError struct {
+	Code        int    `json:"code"`
+	Message     string `json:"message"`
+	ClientToken string `json:"clientToken"`
+}
+
+// ShadowInfo tells how the device shadow is synchronized, it's part of the status
+type ShadowInfo struct {
+	Version   int64      `json:"version"`
+	Synced    bool       `json:"synced"`
+	Accepted  int        `json:"accepted"`
+	Rejected  int        `json:"rejected"`
+	Conflicts int        `json:"conflicts"`
+	Pending   int        `json:"pending"`
+	LastError string     `json:"last_error,omitempty"`
+	LastSync  *time.Time `json:"last_sync,omitempty"`
+	// Properties are the counters of each property reported by the sketches
+	Properties map[string]ShadowPropertyCounters `json:"properties,omitempty"`
+}
+
+// shadowSync keeps the reported state of the device shadow. Only one update is in
+// flight at a time, written against the last known version; the values reported
+// meanwhile are merged and sent when it's accepted or rejected.
+type shadowSync struct {
+	mutex sync.Mutex
+	info  ShadowInfo
+	// reported are the last values accepted by the cloud
+	reported map[string]json.RawMessage
+	// pending are waiting to be sent, inflight have been sent with token
+	pending  map[string]json.RawMessage
+	inflight map[string]json.RawMessage
+	token    string
+	sentAt   time.Time
+	// getAt is when the shadow was requested, zero if it isn't being requested
+	getAt time.Time
+	count int
+
+	// settings tell how often each property is sent, see shadowProperties
+	settings map[string]ShadowPropertySettings
+	// held are the values waiting for the interval of their property to elapse (due)
+	held     map[string]json.RawMessage
+	due      map[string]time.Time
+	queuedAt map[string]time.Time
+	timer    *time.Timer
+	timerAt  time.Time
+	counters map[string]*ShadowPropertyCounters
+}
+
+func newShadowSync() *shadowSync {
+	return &shadowSync{
+		reported: map[string]json.RawMessage{},
+		pending:  map[string]json.RawMessage{},
+		held:     map[string]json.RawMessage{},
+		due:      map[string]time.Time{},
+		queuedAt: map[string]time.Time{},
+		counters: map[string]*ShadowPropertyCounters{},
+	}
+}
+
+// MarshalJSON implements json.Marshaler, for the status
+func (sh *shadowSync) MarshalJSON() ([]byte, error) {
+	sh.mutex.Lock()
+	info := sh.info
+	info.Pending = len(sh.pending) + len(sh.inflight) + len(sh.held)
+	if len(sh.counters) > 0 {
+		info.Properties = map[string]ShadowPropertyCounters{}
+		for name, counters := range sh.counters {
+			info.Properties[name] = *counters
+		}
+	}
+	sh.mutex.Unlock()
+	return json.Marshal(info)
+}
+
+// value returns the last value of a property: held, pending, being sent or accepted
+func (sh *shadowSync) value(name string) (json.RawMessage, bool) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	for _, values := range []map[string]json.RawMessage{sh.held, sh.pending, sh.inflight, sh.reported} {
+		if value, ok := values[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// natsCloudCB reports the values published by the sketches, a request gets OK or
+// ERROR: <reason> when the value is invalid
+func natsCloudCB(s *Status) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		thingName := strings.TrimPrefix(m.Subject, "$arduino.cloud.")
+		err := s.publishReported(map[string]json.RawMessage{thingName: m.Data}, true)
+		if m.Reply != "" {
+			if err != nil {
+				s.natsClient.Publish(m.Reply, []byte("ERROR: "+err.Error()))
+			} else {
+				s.natsClient.Publish(m.Reply, []byte("OK"))
+			}
+		} else if err != nil {
+			s.Error("/shadow", err)
+		}
+	}
+}
+
+// natsCloudGetCB answers the sketches asking for the last value of a property,
+// restored from the device shadow when the connector starts
+func natsCloudGetCB(s *Status) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		if m.Reply == "" {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(m.Subject, "$arduino.cloud."), ".get")
+		value, ok := s.Shadow.value(name)
+		if !ok {
+			s.natsClient.Publish(m.Reply, []byte("ERROR: unknown property "+name))
+			return
+		}
+		s.natsClient.Publish(m.Reply, value)
+	}
+}
+
+// publishReported updates the reported state of the device shadow with some properties,
+// the values are already JSON encoded. The values not matching the schema of their property
+// are left out and returned as error. With coalesce the settings of the properties
+// (interval, deadband, on change) apply.
+func (s *Status) publishReported(properties map[string]json.RawMessage, coalesce bool) error {
+	var invalid []string
+	sh := s.Shadow
+	sh.mutex.Lock()
+	now := time.Now()
+	for name, value := range properties {
+		counters := sh.countersOf(name)
+		counters.Received++
+		settings := sh.settingsOf(name)
+		if err := settings.validate(name, value); err != nil {
+			counters.Invalid++
+			invalid = append(invalid, err.Error())
+			continue
+		}
+		if !coalesce {
+			delete(sh.held, name)
+			delete(sh.due, name)
+			sh.pending[name] = value
+			sh.queuedAt[name] = now
+			continue
+		}
+
+		if baseline, ok := sh.sent(name); ok && !settings.changed(baseline, value) {
+			// back within the deadband of the value in the cloud
+			counters.Filtered++
+			delete(sh.held, name)
+			delete(sh.due, name)
+			delete(sh.pending, name)
+			continue
+		}
+		if queued, ok := sh.queuedAt[name]; ok && settings.Interval > 0 && now.Sub(queued) < settings.interval() {
+			if _, ok := sh.held[name]; ok {
+				counters.Coalesced++
+			}
+			sh.held[name] = value
+			sh.due[name] = queued.Add(settings.interval())
+			sh.schedule(s.releaseHeld)
+			continue
+		}
+		if _, ok := sh.pending[name]; ok {
+			counters.Coalesced++
+		}
+		sh.pending[name] = value
+		sh.queuedAt[name] = now
+	}
+	sh.mutex.Unlock()
+
+	s.flushShadow()
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return errors.New(strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// requestShadow asks for the device shadow, the answer comes on shadow/get/accepted or rejected
+func (s *Status) requestShadow(client mqtt.Client) {
+	s.Shadow.mutex.Lock()
+	s.Shadow.info.Synced = false
+	s.Shadow.getAt = time.Now()
+	s.Shadow.mutex.Unlock()
+	client.Publish("$aws/things/"+s.id+"/shadow/get", 1, false, "")
+	if debugMqtt {
+		fmt.Println("MQTT OUT: $aws/things/" + s.id + "/shadow/get")
+	}
+}
+
+// flushShadow sends the pending values, unless an update is already in flight
+// or the shadow hasn't been fetched yet
+func (s *Status) flushShadow() {
+	sh := s.Shadow
+	sh.mutex.Lock()
+	if s.mqttClient == nil || !sh.info.Synced || sh.inflight != nil || len(sh.pending) == 0 {
+		sh.mutex.Unlock()
+		return
+	}
+	var update struct {
+		State struct {
+			Reported map[string]json.RawMessage `json:"reported"`
+		} `json:"state"`
+		Version     int64  `json:"version,omitempty"`
+		ClientToken string `json:"clientToken"`
+	}
+	// a value which can't be sent would block every later update, it's dropped
+	var invalid []string
+	for name, value := range sh.pending {
+		if !json.Valid(value) {
+			invalid = append(invalid, name)
+			sh.countersOf(name).Invalid++
+			delete(sh.pending, name)
+		}
+	}
+	update.State.Reported = sh.pending
+	update.Version = sh.info.Version
+	update.ClientToken = "arduino-connector-" + strconv.Itoa(sh.count+1)
+	updateMessage, err := json.Marshal(update)
+	if err != nil || len(sh.pending) == 0 {
+		sh.pending = map[string]json.RawMessage{}
+		sh.mutex.Unlock()
+		if err != nil {
+			s.Error("/shadow", errors.Wrap(err, "json marshal"))
+		}
+		if len(invalid) > 0 {
+			s.Error("/shadow", errors.Errorf("dropped the invalid values of %s", strings.Join(invalid, ", ")))
+		}
+		return
+	}
+	sh.count++
+	sh.token = update.ClientToken
+	sh.inflight = sh.pending
+	sh.pending = map[string]json.RawMessage{}
+	for name := range sh.inflight {
+		sh.countersOf(name).Sent++
+	}
+	sh.sentAt = time.Now()
+	sh.mutex.Unlock()
+	if len(invalid) > 0 {
+		s.Error("/shadow", errors.Errorf("dropped the invalid values of %s", strings.Join(invalid, ", ")))
+	}
+
+	if s.messagesSent > 1000 {
+		fmt.Println("rate limiting: " + strconv.Itoa(s.messagesSent))
+		introducedDelay := time.Duration(s.messagesSent/1000) * time.Second
+		if introducedDelay > 20*time.Second {
+			introducedDelay = 20 * time.Second
+		}
+		time.Sleep(introducedDelay)
+	}
+	s.messagesSent++
+	s.mqttClient.Publish("$aws/things/"+s.id+"/shadow/update", 1, false, string(updateMessage))
+	if debugMqtt {
+		fmt.Println("MQTT OUT: $aws/things/"+s.id+"/shadow/update", string(updateMessage))
+	}
+}
+
+// watchShadow sends again the gets and updates left unanswered, and the values
+// reported while the connection was down
+func (s *Status) watchShadow() {
+	for range time.Tick(time.Second) {
+		s.retryShadow()
+	}
+}
+
+// retryShadow sends again what is left unanswered for too long, or rejected, and flushes
+// the pending values
+func (s *Status) retryShadow() {
+	sh := s.Shadow
+	sh.mutex.Lock()
+	getExpired := !sh.getAt.IsZero() && time.Since(sh.getAt) > shadowResponseTimeout
+	if sh.inflight != nil && time.Since(sh.sentAt) > shadowResponseTimeout {
+		sh.requeue()
+	}
+	sh.mutex.Unlock()
+	if getExpired && s.mqttClient != nil {
+		s.requestShadow(s.mqttClient)
+	}
+	s.flushShadow()
+}
+
+// requeue puts back the values in flight before the pending ones, which are newer.
+// The caller holds the mutex.
+func (sh *shadowSync) requeue() {
+	for name, value := range sh.inflight {
+		if _, ok := sh.pending[name]; !ok {
+			sh.pending[name] = value
+		}
+	}
+	sh.inflight = nil
+	sh.token = ""
+}
+
+// ShadowGetAcceptedEvent restores the last known state of the device shadow
+func (s *Status) ShadowGetAcceptedEvent(client mqtt.Client, msg mqtt.Message) {
+	var document ShadowDocument
+	if err := json.Unmarshal(msg.Payload(), &document); err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	sh := s.Shadow
+	sh.mutex.Lock()
+	sh.info.Version = document.Version
+	sh.info.Synced = true
+	now := time.Now()
+	sh.info.LastSync = &now
+	sh.getAt = time.Time{}
+	sh.reported = document.State.Reported
+	if sh.reported == nil {
+		sh.reported = map[string]json.RawMessage{}
+	}
+	sh.mutex.Unlock()
+
+	// the desired changes made while the device was offline
+	if s.natsClient != nil {
+		for name, value := range document.State.Delta {
+			go s.setCloudProperty(name, value)
+		}
+	}
+	s.flushShadow()
+}
+
+// ShadowGetRejectedEvent handles a failed shadow get: a device without shadow starts from scratch,
+// the other errors (throttling, server errors) are retried by watchShadow once the get expires
+func (s *Status) ShadowGetRejectedEvent(client mqtt.Client, msg mqtt.Message) {
+	var rejection ShadowError
+	json.Unmarshal(msg.Payload(), &rejection)
+	sh := s.Shadow
+	sh.mutex.Lock()
+	if rejection.Code == 404 {
+		sh.getAt = time.Time{}
+		sh.info.Version = 0
+		sh.info.Synced = true
+		now := time.Now()
+		sh.info.LastSync = &now
+		sh.mutex.Unlock()
+		s.flushShadow()
+		return
+	}
+	sh.info.LastError = fmt.Sprintf("get: %d %s", rejection.Code, rejection.Message)
+	sh.mutex.Unlock()
+	s.Error("/shadow", errors.Errorf("shadow get rejected: %d %s", rejection.Code, rejection.Message))
+}
+
+// ShadowUpdateAcceptedEvent keeps track of the new version of the shadow
+func (s *Status) ShadowUpdateAcceptedEvent(client mqtt.Client, msg mqtt.Message) {
+	var document ShadowDocument
+	if err := json.Unmarshal(msg.Payload(), &document); err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	sh := s.Shadow
+	sh.mutex.Lock()
+	if document.Version > sh.info.Version {
+		sh.info.Version = document.Version
+	}
+	if document.ClientToken != "" && document.ClientToken == sh.token {
+		for name, value := range sh.inflight {
+			sh.reported[name] = value
+		}
+		sh.inflight = nil
+		sh.token = ""
+		sh.info.Accepted++
+	}
+	sh.mutex.Unlock()
+	s.flushShadow()
+}
+
+// ShadowUpdateRejectedEvent sends again the updates written against an old version,
+// once the shadow is fetched again, and reports the other rejections
+func (s *Status) ShadowUpdateRejectedEvent(client mqtt.Client, msg mqtt.Message) {
+	var rejection ShadowError
+	if err := json.Unmarshal(msg.Payload(), &rejection); err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	sh := s.Shadow
+	sh.mutex.Lock()
+	if rejection.ClientToken == "" || rejection.ClientToken != sh.token {
+		sh.mutex.Unlock()
+		return
+	}
+	if rejection.Code == 409 {
+		sh.info.Conflicts++
+		sh.requeue()
+		sh.mutex.Unlock()
+		s.requestShadow(client)
+		return
+	}
+	rejected := sh.inflight
+	sh.inflight = nil
+	sh.token = ""
+	sh.info.Rejected++
+	sh.info.LastError = fmt.Sprintf("update: %d %s", rejection.Code, rejection.Message)
+	sh.mutex.Unlock()
+
+	var names []string
+	for name := range rejected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s.Error("/shadow", errors.Errorf("shadow update of %s rejected: %d %s", strings.Join(names, ", "), rejection.Code, rejection.Message))
+	s.flushShadow()
+}
+
+// ShadowDeltaEvent forwards the properties changed in the cloud to the sketches, on
+// $arduino.cloud.<property>.set. The value acknowledged by the sketch becomes the reported one.
+func (s *Status) ShadowDeltaEvent(client mqtt.Client, msg mqtt.Message) {
+	var delta ShadowDelta
+	if err := json.Unmarshal(msg.Payload(), &delta); err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	s.Shadow.mutex.Lock()
+	if delta.Version > s.Shadow.info.Version {
+		s.Shadow.info.Version = delta.Version
+	}
+	s.Shadow.mutex.Unlock()
+	if s.natsClient == nil {
+		return
+	}
+	for name, value := range delta.State {
+		go s.setCloudProperty(name, value)
+	}
+}
+
+// setCloudProperty asks the sketches to apply a property. They reply OK (or nothing) when they
+// applied the value, another JSON value if they applied that one instead, or ERROR: <reason>.
+func (s *Status) setCloudProperty(name string, value json.RawMessage) {
+	subject := "$arduino.cloud." + subjectToken(name) + ".set"
+	reply, err := natsRequest(s.natsClient, subject, value, shadowSetTimeout)
+	if err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "set %s", name))
+		return
+	}
+	ack := strings.TrimSpace(string(reply.Data))
+	switch {
+	case strings.HasPrefix(ack, "ERROR:"):
+		s.Error("/shadow", errors.Errorf("set %s: %s", name, strings.TrimSpace(strings.TrimPrefix(ack, "ERROR:"))))
+		return
+	case ack == "" || ack == "OK":
+	case json.Valid(reply.Data):
+		value = json.RawMessage(ack)
+	default:
+		s.Error("/shadow", errors.Errorf("set %s: invalid acknowledgement %q", name, ack))
+		return
+	}
+	if err := s.publishReported(map[string]json.RawMessage{name: value}, false); err != nil {
+		s.Error("/shadow", errors.Wrapf(err, "set %s", name))
+	}
+}
@@ -0,0 +1,170 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// coalesceSlack lets the held values due at about the same time go in the same update
+const coalesceSlack = 50 * time.Millisecond
+
+// ShadowPropertySettings tell how often a property reported by the sketches is sent to the
+// cloud, and which values are valid
+type ShadowPropertySettings struct {
+	// Interval is the minimum time between two updates in milliseconds, only the latest value is sent
+	Interval int `json:"interval"`
+	// Deadband ignores the numeric values closer than this to the one in the cloud
+	Deadband float64 `json:"deadband"`
+	// OnChange ignores the values equal to the one in the cloud
+	OnChange bool `json:"on_change"`
+
+	// Type is number, integer, boolean, string, object or array, any JSON value if empty
+	Type string `json:"type,omitempty"`
+	// Minimum and Maximum are the range of the numeric values
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+}
+
+// ShadowPropertyCounters count what happens to the values of a property
+type ShadowPropertyCounters struct {
+	Received  int `json:"received"`
+	Sent      int `json:"sent"`
+	Filtered  int `json:"filtered"`
+	Coalesced int `json:"coalesced"`
+	Invalid   int `json:"invalid"`
+}
+
+func (p ShadowPropertySettings) interval() time.Duration {
+	return time.Duration(p.Interval) * time.Millisecond
+}
+
+// changed tells if a value is worth sending, compared to the one in the cloud
+func (p ShadowPropertySettings) changed(previous, value json.RawMessage) bool {
+	if p.Deadband > 0 {
+		var a, b float64
+		if json.Unmarshal(previous, &a) == nil && json.Unmarshal(value, &b) == nil {
+			return math.Abs(a-b) > p.Deadband
+		}
+	} else if !p.OnChange {
+		return true
+	}
+	var compactPrevious, compactValue bytes.Buffer
+	if json.Compact(&compactPrevious, previous) != nil || json.Compact(&compactValue, value) != nil {
+		return true
+	}
+	return !bytes.Equal(compactPrevious.Bytes(), compactValue.Bytes())
+}
+
+// loadShadowProperties reads the settings of the properties, as
+// {"*": {"interval": 1000}, "temp": {"interval": 5000, "deadband": 0.5, "type": "number", "minimum": -40},
+// "door": {"on_change": true, "type": "string"}}
+// where "*" applies to the properties not listed
+func loadShadowProperties(path string) (map[string]ShadowPropertySettings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read shadow properties")
+	}
+	settings := map[string]ShadowPropertySettings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %s", path)
+	}
+	for name, property := range settings {
+		if property.Interval < 0 || property.Deadband < 0 {
+			return nil, errors.Errorf("negative interval or deadband for %s in %s", name, path)
+		}
+		if _, ok := shadowTypes[property.Type]; !ok {
+			return nil, errors.Errorf("unknown type %s for %s in %s", property.Type, name, path)
+		}
+	}
+	return settings, nil
+}
+
+// settingsOf returns the settings of a property. The caller holds the mutex.
+func (sh *shadowSync) settingsOf(name string) ShadowPropertySettings {
+	if settings, ok := sh.settings[name]; ok {
+		return settings
+	}
+	return sh.settings["*"]
+}
+
+// countersOf returns the counters of a property. The caller holds the mutex.
+func (sh *shadowSync) countersOf(name string) *ShadowPropertyCounters {
+	counters, ok := sh.counters[name]
+	if !ok {
+		counters = &ShadowPropertyCounters{}
+		sh.counters[name] = counters
+	}
+	return counters
+}
+
+// sent returns the value of a property being sent or in the cloud. The caller holds the mutex.
+func (sh *shadowSync) sent(name string) (json.RawMessage, bool) {
+	if value, ok := sh.inflight[name]; ok {
+		return value, true
+	}
+	value, ok := sh.reported[name]
+	return value, ok
+}
+
+// schedule arms the timer releasing the held values for the first one due.
+// The caller holds the mutex.
+func (sh *shadowSync) schedule(release func()) {
+	var first time.Time
+	for _, due := range sh.due {
+		if first.IsZero() || due.Before(first) {
+			first = due
+		}
+	}
+	if first.IsZero() || (sh.timer != nil && !sh.timerAt.IsZero() && !sh.timerAt.After(first)) {
+		return
+	}
+	if sh.timer == nil {
+		sh.timer = time.AfterFunc(time.Until(first), release)
+	} else {
+		sh.timer.Reset(time.Until(first))
+	}
+	sh.timerAt = first
+}
+
+// releaseHeld sends the held values which are due, together
+func (s *Status) releaseHeld() {
+	sh := s.Shadow
+	sh.mutex.Lock()
+	now := time.Now()
+	sh.timerAt = time.Time{}
+	for name, due := range sh.due {
+		if due.After(now.Add(coalesceSlack)) {
+			continue
+		}
+		sh.pending[name] = sh.held[name]
+		sh.queuedAt[name] = now
+		delete(sh.held, name)
+		delete(sh.due, name)
+	}
+	sh.schedule(s.releaseHeld)
+	sh.mutex.Unlock()
+	s.flushShadow()
+}
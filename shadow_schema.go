@@ -0,0 +1,91 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// shadowTypes tell if a decoded JSON value is of a property type
+var shadowTypes = map[string]func(interface{}) bool{
+	"": func(interface{}) bool { return true },
+	"number": func(v interface{}) bool {
+		_, ok := v.(json.Number)
+		return ok
+	},
+	"integer": func(v interface{}) bool {
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	},
+	"boolean": func(v interface{}) bool {
+		_, ok := v.(bool)
+		return ok
+	},
+	"string": func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	},
+	"object": func(v interface{}) bool {
+		_, ok := v.(map[string]interface{})
+		return ok
+	},
+	"array": func(v interface{}) bool {
+		_, ok := v.([]interface{})
+		return ok
+	},
+}
+
+// validate checks that a value is a single JSON value matching the schema of the property
+func (p ShadowPropertySettings) validate(name string, value json.RawMessage) error {
+	if name == "" {
+		return errors.New("empty property name")
+	}
+	var decoded, extra interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if !json.Valid(value) || decoder.Decode(&decoded) != nil || decoder.Decode(&extra) != io.EOF {
+		return errors.Errorf("%s: %q is not a JSON value", name, value)
+	}
+	if is, ok := shadowTypes[p.Type]; ok && !is(decoded) {
+		return errors.Errorf("%s: %s is not of type %s", name, value, p.Type)
+	}
+	number, ok := decoded.(json.Number)
+	if !ok {
+		return nil
+	}
+	n, err := number.Float64()
+	if err != nil {
+		return errors.Errorf("%s: %s is not a valid number", name, value)
+	}
+	if p.Minimum != nil && n < *p.Minimum {
+		return errors.Errorf("%s: %s is less than %v", name, value, *p.Minimum)
+	}
+	if p.Maximum != nil && n > *p.Maximum {
+		return errors.Errorf("%s: %s is greater than %v", name, value, *p.Maximum)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+type doneToken struct{ mqtt.Token }
+
+func (doneToken) Wait() bool   { return true }
+func (doneToken) Error() error { return nil }
+
+// recordingClient records what is published
+type recordingClient struct {
+	mqtt.Client
+	mutex     sync.Mutex
+	published []string
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// the status is sent as []byte, everything else as string
+	c.published = append(c.published, fmt.Sprintf("%s %s", topic, payload))
+	return doneToken{}
+}
+
+func (c *recordingClient) take() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	published := c.published
+	c.published = nil
+	return published
+}
+
+type payloadMessage struct {
+	mqtt.Message
+	payload string
+}
+
+func (m payloadMessage) Payload() []byte { return []byte(m.payload) }
+
+func TestShadowSync(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+
+	// nothing is sent before the shadow is fetched
+	status.requestShadow(client)
+	status.publishReported(map[string]json.RawMessage{"a": json.RawMessage("1")}, true)
+	assert.Equal(t, []string{"$aws/things/dev/shadow/get "}, client.take())
+
+	status.ShadowGetAcceptedEvent(client, payloadMessage{payload: `{"version": 7, "state": {"reported": {"z": "old"}}}`})
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"a":1}},"version":7,"clientToken":"arduino-connector-1"}`}, client.take())
+	value, _ := status.Shadow.value("z")
+	assert.Equal(t, `"old"`, string(value))
+
+	// one update in flight at a time, a conflict fetches the shadow and merges the values
+	status.publishReported(map[string]json.RawMessage{"b": json.RawMessage("2")}, true)
+	assert.Empty(t, client.take())
+	status.ShadowUpdateRejectedEvent(client, payloadMessage{payload: `{"code": 409, "message": "Version conflict", "clientToken": "arduino-connector-1"}`})
+	assert.Equal(t, []string{"$aws/things/dev/shadow/get "}, client.take())
+	status.ShadowGetAcceptedEvent(client, payloadMessage{payload: `{"version": 9, "state": {"reported": {"z": "old"}}}`})
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"a":1,"b":2}},"version":9,"clientToken":"arduino-connector-2"}`}, client.take())
+	status.ShadowUpdateAcceptedEvent(client, payloadMessage{payload: `{"version": 10, "clientToken": "arduino-connector-2"}`})
+
+	// other rejections are reported
+	status.publishReported(map[string]json.RawMessage{"c": json.RawMessage("3")}, true)
+	status.ShadowUpdateRejectedEvent(client, payloadMessage{payload: `{"code": 400, "message": "Bad request", "clientToken": "arduino-connector-3"}`})
+	published := client.take()
+	assert.Equal(t, `$aws/things/dev/shadow/update {"state":{"reported":{"c":3}},"version":10,"clientToken":"arduino-connector-3"}`, published[0])
+	assert.Contains(t, published[1], "ERROR: shadow update of c rejected: 400 Bad request")
+
+	info, _ := json.Marshal(status.Shadow)
+	assert.Contains(t, string(info), `"version":10,"synced":true,"accepted":1,"rejected":1,"conflicts":1,"pending":0,"last_error":"update: 400 Bad request"`)
+}
+
+func TestShadowCoalescing(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.Shadow.settings = map[string]ShadowPropertySettings{
+		"temp": {Interval: 100, Deadband: 0.5},
+		"door": {OnChange: true},
+	}
+	status.requestShadow(client)
+	status.ShadowGetAcceptedEvent(client, payloadMessage{payload: `{"version": 1, "state": {"reported": {"temp": 20, "door": "open"}}}`})
+	client.take()
+
+	// close to or equal to the values in the cloud
+	status.publishReported(map[string]json.RawMessage{"temp": json.RawMessage("20.3"), "door": json.RawMessage(`"open"`)}, true)
+	assert.Empty(t, client.take())
+
+	status.publishReported(map[string]json.RawMessage{"temp": json.RawMessage("21")}, true)
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"temp":21}},"version":1,"clientToken":"arduino-connector-1"}`}, client.take())
+	status.ShadowUpdateAcceptedEvent(client, payloadMessage{payload: `{"version": 2, "clientToken": "arduino-connector-1"}`})
+
+	// within the interval only the latest value is sent, when it elapses
+	status.publishReported(map[string]json.RawMessage{"temp": json.RawMessage("22")}, true)
+	status.publishReported(map[string]json.RawMessage{"temp": json.RawMessage("22.5")}, true)
+	assert.Empty(t, client.take())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"temp":22.5}},"version":2,"clientToken":"arduino-connector-2"}`}, client.take())
+
+	info, _ := json.Marshal(status.Shadow)
+	assert.Contains(t, string(info), `"properties":{"door":{"received":1,"sent":0,"filtered":1,"coalesced":0,"invalid":0},"temp":{"received":4,"sent":2,"filtered":1,"coalesced":1,"invalid":0}}`)
+}
+
+func TestShadowPropertyValidation(t *testing.T) {
+	minimum, maximum := -40.0, 85.0
+	temp := ShadowPropertySettings{Type: "number", Minimum: &minimum, Maximum: &maximum}
+	assert.NoError(t, temp.validate("temp", json.RawMessage("21.5")))
+	assert.Error(t, temp.validate("temp", json.RawMessage("90")))
+	assert.Error(t, temp.validate("temp", json.RawMessage(`"21.5"`)))
+	assert.Error(t, temp.validate("temp", json.RawMessage("21.5, \"injected\": 1")))
+	assert.Error(t, ShadowPropertySettings{}.validate("temp", json.RawMessage("not json")))
+	assert.Error(t, ShadowPropertySettings{}.validate("temp", json.RawMessage("1}")))
+	assert.Error(t, ShadowPropertySettings{}.validate("temp", json.RawMessage("1]")))
+	assert.Error(t, ShadowPropertySettings{}.validate("temp", json.RawMessage(`{"a":1}}`)))
+	assert.Error(t, ShadowPropertySettings{}.validate("temp", json.RawMessage("1 2")))
+	assert.Error(t, ShadowPropertySettings{}.validate("", json.RawMessage("1")))
+	assert.NoError(t, ShadowPropertySettings{Type: "integer"}.validate("count", json.RawMessage("3")))
+	assert.Error(t, ShadowPropertySettings{Type: "integer"}.validate("count", json.RawMessage("3.5")))
+
+	// names are escaped in the document
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.Shadow.settings = map[string]ShadowPropertySettings{"temp": temp}
+	status.ShadowGetRejectedEvent(client, payloadMessage{payload: `{"code": 404, "message": "No shadow exists"}`})
+	err := status.publishReported(map[string]json.RawMessage{`a"b`: json.RawMessage("1"), "temp": json.RawMessage("100")}, true)
+	assert.EqualError(t, err, "temp: 100 is greater than 85")
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"a\"b":1}},"clientToken":"arduino-connector-1"}`}, client.take())
+
+	// a malformed value that got through is dropped, and doesn't block the next updates
+	status.ShadowUpdateAcceptedEvent(client, payloadMessage{payload: `{"version": 2, "clientToken": "arduino-connector-1"}`})
+	status.Shadow.mutex.Lock()
+	status.Shadow.pending["bad"] = json.RawMessage("1}")
+	status.Shadow.mutex.Unlock()
+	status.flushShadow()
+	assert.Equal(t, []string{"$aws/things/dev/shadow ERROR: dropped the invalid values of bad\n"}, client.take())
+	assert.NoError(t, status.publishReported(map[string]json.RawMessage{"temp": json.RawMessage("22")}, true))
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"temp":22}},"version":2,"clientToken":"arduino-connector-2"}`}, client.take())
+}
+
+func TestShadowGetRetry(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	status.requestShadow(client)
+	status.publishReported(map[string]json.RawMessage{"a": json.RawMessage("1")}, true)
+	client.take()
+
+	// a transient rejection is retried once the get expires, and the values are sent then
+	status.ShadowGetRejectedEvent(client, payloadMessage{payload: `{"code": 429, "message": "Too Many Requests"}`})
+	assert.Equal(t, []string{"$aws/things/dev/shadow ERROR: shadow get rejected: 429 Too Many Requests\n"}, client.take())
+	status.retryShadow()
+	assert.Empty(t, client.take())
+
+	status.Shadow.mutex.Lock()
+	status.Shadow.getAt = time.Now().Add(-shadowResponseTimeout - time.Second)
+	status.Shadow.mutex.Unlock()
+	status.retryShadow()
+	assert.Equal(t, []string{"$aws/things/dev/shadow/get "}, client.take())
+
+	status.ShadowGetAcceptedEvent(client, payloadMessage{payload: `{"version": 3, "state": {"reported": {}}}`})
+	assert.Equal(t, []string{`$aws/things/dev/shadow/update {"state":{"reported":{"a":1}},"version":3,"clientToken":"arduino-connector-1"}`}, client.take())
+}
@@ -0,0 +1,334 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A bundle is a tar.gz archive containing a manifest.json and the files of the sketch.
+// The archive is handled like any other sketch binary (upload, versions, rollback)
+// and it's extracted in sketches/bundles/<name>-<sha256> when the sketch starts.
+const bundleManifestName = "manifest.json"
+
+// bundleVersionSuffix is the end of the folder of an extracted bundle, <name>-<sha256[:16]>
+var bundleVersionSuffix = regexp.MustCompile(`^-[0-9a-f]{16}$`)
+
+// BundleManifest describes how to run a bundle
+type BundleManifest struct {
+	// Entrypoint is the file to execute, relative to the bundle root
+	Entrypoint string `json:"entrypoint"`
+	// Interpreter runs the entrypoint (eg. python3, node), if empty the entrypoint is executed directly
+	Interpreter string   `json:"interpreter,omitempty"`
+	Args        []string `json:"args,omitempty"`
+	// Assets are files or folders that must be part of the bundle
+	Assets []string `json:"assets,omitempty"`
+	// Lib is a folder of the bundle added to LD_LIBRARY_PATH
+	Lib string `json:"lib,omitempty"`
+	// Container runs the bundle in a container instead of on the host
+	Container *SketchContainer `json:"container,omitempty"`
+}
+
+// isBundle tells if the file is a gzip compressed archive
+func isBundle(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(file, magic)
+	return err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b})
+}
+
+// insideFolder joins name to folder, refusing names that escape from it
+func insideFolder(folder, name string) (string, error) {
+	path := filepath.Join(folder, name)
+	if path != folder && !strings.HasPrefix(path, folder+string(filepath.Separator)) {
+		return "", errors.New("invalid path " + name)
+	}
+	return path, nil
+}
+
+// noLinkInPath refuses the paths going through a symbolic link between folder and path
+func noLinkInPath(folder, path string) error {
+	rel, err := filepath.Rel(folder, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	current := folder
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("invalid path " + path + ", it goes through a link")
+		}
+	}
+	return nil
+}
+
+// extractBundle unpacks the archive in dest, which must be empty. The links are
+// created after the other files, so that nothing is written through them, and
+// each one must resolve inside dest.
+func extractBundle(archive, dest string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return errors.Wrap(err, "open bundle")
+	}
+	defer gz.Close()
+
+	type link struct{ name, path, target string }
+	var links []link
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read bundle")
+		}
+
+		path, err := insideFolder(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(path), 0700)
+			if err == nil {
+				err = writeBundleFile(path, tr, os.FileMode(header.Mode)&0700|0600)
+			}
+		case tar.TypeSymlink:
+			// only links pointing inside the bundle are allowed
+			if filepath.IsAbs(header.Linkname) {
+				return errors.New("invalid link " + header.Name)
+			}
+			if _, err = insideFolder(dest, filepath.Join(filepath.Dir(header.Name), header.Linkname)); err != nil {
+				return err
+			}
+			links = append(links, link{name: header.Name, path: path, target: header.Linkname})
+		default:
+			// devices, fifos and hard links have no place in a bundle
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extract %s", header.Name)
+		}
+	}
+
+	for _, l := range links {
+		err := noLinkInPath(dest, l.path)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(l.path), 0700)
+		}
+		if err == nil {
+			err = os.Symlink(l.target, l.path)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extract %s", l.name)
+		}
+	}
+	// the links can still escape together, through the parent of another link
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		resolved, err := filepath.EvalSymlinks(l.path)
+		if err != nil {
+			return errors.Wrapf(err, "invalid link %s", l.name)
+		}
+		if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return errors.New("invalid link " + l.name)
+		}
+	}
+	return nil
+}
+
+func writeBundleFile(path string, r io.Reader, mode os.FileMode) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readBundleManifest reads and validates the manifest of an extracted bundle
+func readBundleManifest(folder string) (*BundleManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, bundleManifestName))
+	if err != nil {
+		return nil, errors.Wrap(err, "read bundle manifest")
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrap(err, "parse bundle manifest")
+	}
+
+	if manifest.Entrypoint == "" {
+		return nil, errors.New("the bundle manifest doesn't declare an entrypoint")
+	}
+	entrypoint, err := insideFolder(folder, manifest.Entrypoint)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(entrypoint); err != nil {
+		return nil, errors.Wrap(err, "bundle entrypoint")
+	}
+	for _, asset := range manifest.Assets {
+		path, err := insideFolder(folder, asset)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, errors.Wrap(err, "bundle asset")
+		}
+	}
+	if manifest.Lib != "" {
+		if _, err := insideFolder(folder, manifest.Lib); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Interpreter != "" && manifest.Container == nil {
+		if _, err := exec.LookPath(manifest.Interpreter); err != nil {
+			return nil, errors.Wrap(err, "bundle interpreter")
+		}
+	}
+	return &manifest, nil
+}
+
+// prepareBundle extracts the archive, unless it's already extracted, and returns
+// the folder of the bundle and its manifest. Folders of other versions of the same
+// sketch are removed when cleanup is set.
+func prepareBundle(archive string, cleanup bool) (string, *BundleManifest, error) {
+	bundlesFolder, err := getSketchSubFolder("bundles")
+	if err != nil {
+		return "", nil, err
+	}
+	sha, err := fileSHA256(archive)
+	if err != nil {
+		return "", nil, err
+	}
+	name := filepath.Base(archive)
+	folder := filepath.Join(bundlesFolder, name+"-"+sha[:16])
+
+	if _, err := os.Stat(folder); os.IsNotExist(err) {
+		tmp, err := ioutil.TempDir(bundlesFolder, ".extract-")
+		if err != nil {
+			return "", nil, err
+		}
+		if err := extractBundle(archive, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return "", nil, err
+		}
+		if err := os.Rename(tmp, folder); err != nil {
+			os.RemoveAll(tmp)
+			return "", nil, err
+		}
+	}
+
+	manifest, err := readBundleManifest(folder)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cleanup {
+		for _, other := range staleBundleFolders(bundlesFolder, name, folder) {
+			os.RemoveAll(other)
+		}
+	}
+	return folder, manifest, nil
+}
+
+// staleBundleFolders returns the folders of the other versions of the bundle name,
+// leaving out keep and the bundles of the sketches whose name starts with name
+func staleBundleFolders(bundlesFolder, name, keep string) []string {
+	entries, err := ioutil.ReadDir(bundlesFolder)
+	if err != nil {
+		return nil
+	}
+	var stale []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) || !bundleVersionSuffix.MatchString(entry.Name()[len(name):]) {
+			continue
+		}
+		if folder := filepath.Join(bundlesFolder, entry.Name()); folder != keep {
+			stale = append(stale, folder)
+		}
+	}
+	return stale
+}
+
+// sketchCommand returns the command running the sketch at path,
+// either an executable or a bundle, and the manifest of the bundle
+func sketchCommand(path string) (*exec.Cmd, *BundleManifest, error) {
+	if !isBundle(path) {
+		return exec.Command(path), nil, nil
+	}
+
+	folder, manifest, err := prepareBundle(path, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	entrypoint := filepath.Join(folder, manifest.Entrypoint)
+
+	var cmd *exec.Cmd
+	if manifest.Interpreter != "" {
+		cmd = exec.Command(manifest.Interpreter, append([]string{entrypoint}, manifest.Args...)...)
+	} else {
+		os.Chmod(entrypoint, 0700)
+		cmd = exec.Command(entrypoint, manifest.Args...)
+	}
+	cmd.Dir = folder
+	cmd.Env = os.Environ()
+	if manifest.Lib != "" {
+		cmd.Env = append(cmd.Env, "LD_LIBRARY_PATH="+filepath.Join(folder, manifest.Lib)+":"+os.Getenv("LD_LIBRARY_PATH"))
+	}
+	return cmd, manifest, nil
+}
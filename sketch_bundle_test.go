@@ -0,0 +1,126 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bundleEntry is a file of a test archive, a link if target is set
+type bundleEntry struct {
+	name, content, target string
+}
+
+func writeTestBundle(t *testing.T, path string, entries []bundleEntry) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0600, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if entry.target != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.target}
+		}
+		tw.WriteHeader(header)
+		tw.Write([]byte(entry.content))
+	}
+}
+
+func TestExtractBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		entries []bundleEntry
+		valid   bool
+	}{
+		{"files and links", []bundleEntry{
+			{name: "manifest.json", content: `{"entrypoint": "bin/run"}`},
+			{name: "bin/run", content: "#!/bin/sh"},
+			{name: "run", target: "bin/run"},
+			{name: "lib/current", target: "../bin"},
+		}, true},
+		{"absolute link", []bundleEntry{{name: "passwd", target: "/etc/passwd"}}, false},
+		{"link outside", []bundleEntry{{name: "a/up", target: "../.."}}, false},
+		{"write through chained links", []bundleEntry{
+			{name: "a/b", target: ".."},
+			{name: "a/b/c", target: ".."},
+			{name: "a/b/c/evil", content: "evil"},
+		}, false},
+		{"links escaping together", []bundleEntry{
+			{name: "x/d", target: ".."},
+			{name: "x/l", target: "d/.."},
+		}, false},
+	}
+	for i, test := range tests {
+		archive := filepath.Join(dir, test.name+".tar.gz")
+		writeTestBundle(t, archive, test.entries)
+		dest := filepath.Join(dir, "dest", strconv.Itoa(i), "bundle")
+		os.MkdirAll(dest, 0700)
+
+		err := extractBundle(archive, dest)
+		if test.valid {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+		_, err = os.Stat(filepath.Join(dest, "..", "evil"))
+		assert.True(t, os.IsNotExist(err), test.name)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dest", "0", "bundle", "lib", "current", "run"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh", string(content))
+}
+
+func TestStaleBundleFolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"foo-0123456789abcdef", "foo-fedcba9876543210", "foo-bar-0123456789abcdef",
+		"foo-0123456789abcdeff", "foo-0123456789ABCDEF", "foobar-0123456789abcdef", ".extract-foo",
+	} {
+		os.Mkdir(filepath.Join(dir, name), 0700)
+	}
+
+	keep := filepath.Join(dir, "foo-0123456789abcdef")
+	assert.Equal(t, []string{filepath.Join(dir, "foo-fedcba9876543210")}, staleBundleFolders(dir, "foo", keep))
+	assert.Equal(t, []string{filepath.Join(dir, "foo-bar-0123456789abcdef")}, staleBundleFolders(dir, "foo-bar", ""))
+	assert.Empty(t, staleBundleFolders(dir, "bar", ""))
+}
@@ -0,0 +1,302 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// SketchContainer makes a sketch run inside a container of Image instead of on the host.
+// The files of the sketch are bind mounted at the same path, so the sketch runs unmodified.
+type SketchContainer struct {
+	Image string `json:"image"`
+	// Devices are the /dev nodes passed through, as host[:container[:permissions]]
+	Devices []string `json:"devices,omitempty"`
+	// Network is the docker network to join, the host network (where NATS listens) by default.
+	// Other networks reach NATS only through nats_socket.
+	Network string `json:"network,omitempty"`
+}
+
+// containerEnvPrefixes are the variables of the sketch environment passed to the container,
+// the rest of the environment of the connector stays on the host
+var containerEnvPrefixes = []string{
+	"ARDUINO_", "NATS_", "MQTT_URL=", "LD_LIBRARY_PATH=",
+	"DISPLAY=", "XAUTHORITY=", "WAYLAND_DISPLAY=", "XDG_RUNTIME_DIR=", "DBUS_SESSION_BUS_ADDRESS=",
+}
+
+// containerName is the name of the container running the sketch
+func containerName(id string) string {
+	return "arduino-sketch-" + subjectToken(id)
+}
+
+// parseDeviceMapping parses host[:container[:permissions]]
+func parseDeviceMapping(device string) container.DeviceMapping {
+	parts := strings.SplitN(device, ":", 3)
+	mapping := container.DeviceMapping{PathOnHost: parts[0], PathInContainer: parts[0], CgroupPermissions: "rwm"}
+	if len(parts) > 1 && parts[1] != "" {
+		mapping.PathInContainer = parts[1]
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		mapping.CgroupPermissions = parts[2]
+	}
+	return mapping
+}
+
+// containerEnv returns the variables of the sketch environment passed to a container joining
+// network. The local NATS server and MQTT broker listen on the loopback of the host: outside of
+// the host network the sketch can only use the NATS socket, mounted by containerBinds.
+func containerEnv(sketchEnv []string, network string) ([]string, error) {
+	var env []string
+	hostOnly := false
+	socket := false
+	for _, variable := range sketchEnv {
+		passed := false
+		for _, prefix := range containerEnvPrefixes {
+			if strings.HasPrefix(variable, prefix) {
+				passed = true
+				break
+			}
+		}
+		if !passed {
+			continue
+		}
+		socket = socket || strings.HasPrefix(variable, "NATS_SOCKET=")
+		if network != "host" && (strings.HasPrefix(variable, "NATS_URL=") || strings.HasPrefix(variable, "MQTT_URL=")) {
+			hostOnly = true
+			continue
+		}
+		env = append(env, variable)
+	}
+	if hostOnly && !socket {
+		return nil, errors.New("the network " + network + " can't reach the local NATS server, use the host network or set nats_socket")
+	}
+	return env, nil
+}
+
+// containerBinds returns the bind mounts of the files of the sketch run by cmd: its
+// bundle or its binary, the shared libraries and the NATS socket
+func containerBinds(cmd *exec.Cmd, env []string, folder string) []string {
+	var binds []string
+	if cmd.Dir != "" {
+		binds = append(binds, cmd.Dir+":"+cmd.Dir+":ro")
+	} else {
+		binds = append(binds, cmd.Path+":"+cmd.Path+":ro")
+	}
+	lib := filepath.Join(folder, "lib")
+	if _, err := os.Stat(lib); err == nil {
+		binds = append(binds, lib+":"+lib+":ro")
+	}
+	for _, variable := range env {
+		if strings.HasPrefix(variable, "NATS_SOCKET=") {
+			socket := strings.TrimPrefix(variable, "NATS_SOCKET=")
+			binds = append(binds, socket+":"+socket)
+		}
+	}
+	return binds
+}
+
+// sketchContainerFor returns the container settings of a sketch: those declared
+// in its bundle manifest or those sent with the upload. nil means run on the host.
+func sketchContainerFor(id string, manifest *BundleManifest) *SketchContainer {
+	if manifest != nil && manifest.Container != nil {
+		return manifest.Container
+	}
+	settings := map[string]*SketchContainer{}
+	if err := loadSketchSettings("containers", &settings); err != nil {
+		return nil
+	}
+	return settings[id]
+}
+
+// saveSketchContainer stores the container settings of a sketch, nil means run on the host
+func saveSketchContainer(id string, settings *SketchContainer) error {
+	all := map[string]*SketchContainer{}
+	if err := loadSketchSettings("containers", &all); err != nil {
+		return err
+	}
+	if settings == nil || settings.Image == "" {
+		delete(all, id)
+	} else {
+		all[id] = settings
+	}
+	return saveSketchSettings("containers", all)
+}
+
+// pullImageIfMissing pulls the image unless it's already on the device
+func (status *Status) pullImageIfMissing(ctx context.Context, image string) error {
+	if _, _, err := status.dockerClient.ImageInspectWithRaw(ctx, image); err == nil {
+		return nil
+	}
+	status.Info("/upload", "Pulling image "+image)
+	out, err := status.dockerClient.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "pull %s", image)
+	}
+	defer out.Close()
+	_, err = io.Copy(ioutil.Discard, out)
+	return err
+}
+
+// spawnContainer runs the sketch command in a container. Like spawnProcess, it streams
+// the output on /stdout and keeps track of the sketch until it exits.
+func (status *Status) spawnContainer(cmd *exec.Cmd, sketch *SketchStatus, settings *SketchContainer) (int, error) {
+	if status.dockerClient == nil {
+		return 0, errors.New("docker is not available on this device")
+	}
+	ctx := context.Background()
+	if err := status.pullImageIfMissing(ctx, settings.Image); err != nil {
+		return 0, err
+	}
+
+	folder, err := getSketchFolder()
+	if err != nil {
+		return 0, err
+	}
+
+	network := settings.Network
+	if network == "" {
+		network = "host"
+	}
+	env, err := containerEnv(cmd.Env, network)
+	if err != nil {
+		return 0, err
+	}
+	config := &container.Config{
+		Image:        settings.Image,
+		Cmd:          cmd.Args,
+		Entrypoint:   []string{},
+		Env:          env,
+		WorkingDir:   cmd.Dir,
+		Tty:          true,
+		OpenStdin:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Labels:       map[string]string{"cc.arduino.sketch": sketch.ID},
+	}
+	hostConfig := &container.HostConfig{
+		Binds:       containerBinds(cmd, env, folder),
+		NetworkMode: container.NetworkMode(network),
+		AutoRemove:  true,
+	}
+	for _, device := range settings.Devices {
+		hostConfig.Devices = append(hostConfig.Devices, parseDeviceMapping(device))
+	}
+
+	// a container left behind by a previous run would have the same name
+	name := containerName(sketch.ID)
+	status.dockerClient.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true})
+
+	created, err := status.dockerClient.ContainerCreate(ctx, config, hostConfig, nil, name)
+	if err != nil {
+		return 0, errors.Wrap(err, "create container")
+	}
+	attached, err := status.dockerClient.ContainerAttach(ctx, created.ID, types.ContainerAttachOptions{
+		Stream: true, Stdin: true, Stdout: true, Stderr: true,
+	})
+	if err != nil {
+		status.dockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+		return 0, errors.Wrap(err, "attach container")
+	}
+	// wait before starting, a container removed on exit can't be waited anymore
+	exited, waitErr := status.dockerClient.ContainerWait(ctx, created.ID, container.WaitConditionNextExit)
+
+	if err := status.dockerClient.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+		attached.Close()
+		status.dockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+		return 0, errors.Wrap(err, "start container")
+	}
+	inspect, err := status.dockerClient.ContainerInspect(ctx, created.ID)
+	if err != nil || inspect.State == nil {
+		attached.Close()
+		status.dockerClient.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+		return 0, errors.Wrap(err, "inspect container")
+	}
+	pid := inspect.State.Pid
+
+	if status.mqttClient != nil {
+		go status.mqttClient.Subscribe("$aws/things/"+status.id+"/stdin", 1, stdInCB(attached.Conn, status))
+	}
+
+	go func() {
+		for {
+			temp := make([]byte, 1000)
+			len, err := attached.Reader.Read(temp)
+			if len > 0 {
+				status.Raw("/stdout", string(temp[:len]))
+				checkSketchForMissingDisplayEnvVariable(string(temp[:len]), sketch, status)
+				status.extractTelemetry(sketch, temp[:len])
+			}
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	process, _ := os.FindProcess(pid)
+	done := make(chan struct{})
+	sketch.process = process
+	sketch.done = done
+	sketch.container = created.ID
+	go func() {
+		var err error
+		select {
+		case result := <-exited:
+			if result.StatusCode != 0 {
+				err = fmt.Errorf("exit status %d", result.StatusCode)
+			}
+		case err = <-waitErr:
+		}
+		attached.Close()
+		close(done)
+		fmt.Println("sketch exited ")
+		status.sketchExited(sketch, process, err)
+	}()
+
+	return pid, nil
+}
+
+// killSketch sends a signal to the processes of a sketch: its process group,
+// or its container
+func (status *Status) killSketch(containerID string, group *processGroup, signal syscall.Signal) error {
+	if containerID == "" {
+		return group.kill(signal)
+	}
+	ctx := context.Background()
+	switch signal {
+	case syscall.SIGSTOP:
+		return status.dockerClient.ContainerPause(ctx, containerID)
+	case syscall.SIGCONT:
+		return status.dockerClient.ContainerUnpause(ctx, containerID)
+	}
+	return status.dockerClient.ContainerKill(ctx, containerID, strconv.Itoa(int(signal)))
+}
@@ -0,0 +1,69 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerEnv(t *testing.T) {
+	sketchEnv := []string{"HOME=/root", "ARDUINO_SKETCH_ID=blink", "NATS_URL=nats://127.0.0.1:4222", "MQTT_URL=tcp://127.0.0.1:1883"}
+
+	env, err := containerEnv(sketchEnv, "host")
+	assert.NoError(t, err)
+	assert.Equal(t, sketchEnv[1:], env)
+
+	_, err = containerEnv(sketchEnv, "bridge")
+	assert.Error(t, err)
+
+	env, err = containerEnv(append(sketchEnv, "NATS_SOCKET=/run/nats.sock"), "bridge")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ARDUINO_SKETCH_ID=blink", "NATS_SOCKET=/run/nats.sock"}, env)
+
+	env, err = containerEnv([]string{"ARDUINO_SKETCH_ID=blink"}, "bridge")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ARDUINO_SKETCH_ID=blink"}, env)
+}
+
+func TestContainerBinds(t *testing.T) {
+	folder, err := ioutil.TempDir("", "sketches")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+	binary := filepath.Join(folder, "blink")
+
+	assert.Equal(t, []string{binary + ":" + binary + ":ro"}, containerBinds(exec.Command(binary), nil, folder))
+
+	os.Mkdir(filepath.Join(folder, "lib"), 0700)
+	bundle := exec.Command("python3", "main.py")
+	bundle.Dir = filepath.Join(folder, "bundles", "blink-1")
+	lib := filepath.Join(folder, "lib")
+	assert.Equal(t, []string{
+		bundle.Dir + ":" + bundle.Dir + ":ro",
+		lib + ":" + lib + ":ro",
+		"/run/nats.sock:/run/nats.sock",
+	}, containerBinds(bundle, []string{"NATS_SOCKET=/run/nats.sock"}, folder))
+}
@@ -0,0 +1,347 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+)
+
+// DisplaySettings tells a sketch which graphical session to use.
+// With Session set to "auto" the empty fields are filled from the active
+// graphical session (of User, if set).
+type DisplaySettings struct {
+	Display        string `json:"display,omitempty"`
+	XAuthority     string `json:"xauthority,omitempty"`
+	WaylandDisplay string `json:"wayland_display,omitempty"`
+	User           string `json:"user,omitempty"`
+	Session        string `json:"session,omitempty"`
+}
+
+// GraphicalSession is a session of a logged in user with a display
+type GraphicalSession struct {
+	ID             string `json:"id"`
+	User           string `json:"user"`
+	UID            uint32 `json:"uid"`
+	Type           string `json:"type"`
+	Active         bool   `json:"active"`
+	Display        string `json:"display,omitempty"`
+	XAuthority     string `json:"xauthority,omitempty"`
+	WaylandDisplay string `json:"wayland_display,omitempty"`
+	RuntimeDir     string `json:"runtime_dir,omitempty"`
+}
+
+// graphicalSessions lists the sessions known to logind, or found in /run/user
+// and /tmp/.X11-unix when logind is not available
+func graphicalSessions() []GraphicalSession {
+	sessions, err := logindSessions()
+	if err != nil || len(sessions) == 0 {
+		sessions = runtimeDirSessions()
+	}
+	// active sessions first
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Active && !sessions[j].Active
+	})
+	return sessions
+}
+
+func logindSessions() ([]GraphicalSession, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []struct {
+		ID   string
+		UID  uint32
+		User string
+		Seat string
+		Path dbus.ObjectPath
+	}
+	manager := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	err = manager.Call("org.freedesktop.login1.Manager.ListSessions", 0).Store(&list)
+	if err != nil {
+		return nil, errors.Wrap(err, "list logind sessions")
+	}
+
+	var sessions []GraphicalSession
+	for _, item := range list {
+		object := conn.Object("org.freedesktop.login1", item.Path)
+		property := func(name string) interface{} {
+			value, err := object.GetProperty("org.freedesktop.login1.Session." + name)
+			if err != nil {
+				return nil
+			}
+			return value.Value()
+		}
+		sessionType, _ := property("Type").(string)
+		if sessionType != "x11" && sessionType != "wayland" {
+			continue
+		}
+		session := GraphicalSession{ID: item.ID, User: item.User, UID: item.UID, Type: sessionType}
+		session.Active, _ = property("Active").(bool)
+		session.Display, _ = property("Display").(string)
+		session.fillFromRuntimeDir()
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// runtimeDirSessions guesses the graphical sessions from the user runtime
+// folders and the X11 sockets
+func runtimeDirSessions() []GraphicalSession {
+	var sessions []GraphicalSession
+	dirs, _ := filepath.Glob("/run/user/*")
+	for _, dir := range dirs {
+		uid, err := strconv.ParseUint(filepath.Base(dir), 10, 32)
+		if err != nil {
+			continue
+		}
+		session := GraphicalSession{UID: uint32(uid), Type: "wayland", Active: true}
+		if u, err := user.LookupId(filepath.Base(dir)); err == nil {
+			session.User = u.Username
+		}
+		session.fillFromRuntimeDir()
+		if session.WaylandDisplay != "" {
+			session.ID = "wayland-" + filepath.Base(dir)
+			sessions = append(sessions, session)
+		}
+	}
+
+	sockets, _ := filepath.Glob("/tmp/.X11-unix/X*")
+	for _, socket := range sockets {
+		info, err := os.Stat(socket)
+		if err != nil {
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		session := GraphicalSession{
+			ID:      "x11-" + strings.TrimPrefix(filepath.Base(socket), "X"),
+			UID:     stat.Uid,
+			Type:    "x11",
+			Active:  true,
+			Display: ":" + strings.TrimPrefix(filepath.Base(socket), "X"),
+		}
+		if u, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+			session.User = u.Username
+		}
+		session.fillFromRuntimeDir()
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// fillFromRuntimeDir looks for the Wayland socket and the X authority file of the session user
+func (s *GraphicalSession) fillFromRuntimeDir() {
+	dir := filepath.Join("/run/user", strconv.Itoa(int(s.UID)))
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	s.RuntimeDir = dir
+	if s.WaylandDisplay == "" {
+		if sockets, _ := filepath.Glob(filepath.Join(dir, "wayland-[0-9]*")); len(sockets) > 0 {
+			for _, socket := range sockets {
+				if !strings.HasSuffix(socket, ".lock") {
+					s.WaylandDisplay = filepath.Base(socket)
+					break
+				}
+			}
+		}
+	}
+
+	candidates := []string{filepath.Join(dir, "gdm", "Xauthority")}
+	if xauth, _ := filepath.Glob(filepath.Join(dir, "xauth_*")); len(xauth) > 0 {
+		candidates = append(candidates, xauth...)
+	}
+	if u, err := user.LookupId(strconv.Itoa(int(s.UID))); err == nil {
+		candidates = append(candidates, filepath.Join(u.HomeDir, ".Xauthority"))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			s.XAuthority = candidate
+			break
+		}
+	}
+}
+
+// resolve fills the empty settings from the matching graphical session, when Session is set
+func (d DisplaySettings) resolve() (DisplaySettings, *GraphicalSession, error) {
+	if d.Session == "" {
+		return d, nil, nil
+	}
+	for _, session := range graphicalSessions() {
+		if d.Session != "auto" && d.Session != session.ID {
+			continue
+		}
+		if d.User != "" && d.User != session.User {
+			continue
+		}
+		if d.Display == "" {
+			d.Display = session.Display
+		}
+		if d.XAuthority == "" {
+			d.XAuthority = session.XAuthority
+		}
+		if d.WaylandDisplay == "" {
+			d.WaylandDisplay = session.WaylandDisplay
+		}
+		return d, &session, nil
+	}
+	return d, nil, errors.Errorf("no graphical session matching %s found", d.Session)
+}
+
+// applyDisplaySettings sets the display environment of the sketch command
+func applyDisplaySettings(cmd *exec.Cmd, settings *DisplaySettings) error {
+	if settings == nil {
+		return nil
+	}
+	resolved, session, err := settings.resolve()
+	if err != nil {
+		return err
+	}
+	env := map[string]string{
+		"DISPLAY":         resolved.Display,
+		"XAUTHORITY":      resolved.XAuthority,
+		"WAYLAND_DISPLAY": resolved.WaylandDisplay,
+	}
+	if session != nil && session.RuntimeDir != "" {
+		env["XDG_RUNTIME_DIR"] = session.RuntimeDir
+		if _, err := os.Stat(filepath.Join(session.RuntimeDir, "bus")); err == nil {
+			env["DBUS_SESSION_BUS_ADDRESS"] = "unix:path=" + filepath.Join(session.RuntimeDir, "bus")
+		}
+	}
+	for name, value := range env {
+		if value != "" {
+			cmd.Env = setEnv(cmd.Env, name, value)
+		}
+	}
+	return nil
+}
+
+// setEnv replaces or adds a variable to an environment
+func setEnv(env []string, name, value string) []string {
+	for i, variable := range env {
+		if strings.HasPrefix(variable, name+"=") {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
+
+// saveDisplaySettings stores the display settings of a sketch, nil removes them
+func saveDisplaySettings(id string, display *DisplaySettings) error {
+	settings := map[string]*DisplaySettings{}
+	if err := loadSketchSettings("display", &settings); err != nil {
+		return err
+	}
+	if display == nil {
+		delete(settings, id)
+	} else {
+		settings[id] = display
+	}
+	return saveSketchSettings("display", settings)
+}
+
+// displaySettingsFor returns the display settings of a sketch, nil if it has none
+func displaySettingsFor(id string) *DisplaySettings {
+	settings := map[string]*DisplaySettings{}
+	if err := loadSketchSettings("display", &settings); err != nil {
+		return nil
+	}
+	return settings[id]
+}
+
+// checkSketchForMissingDisplayEnvVariable reports once per run that a sketch can't
+// open its display
+func checkSketchForMissingDisplayEnvVariable(errorString string, sketch *SketchStatus, status *Status) {
+	if !strings.Contains(errorString, "Can't open display") && !strings.Contains(errorString, "cannot open display") {
+		return
+	}
+	if sketch.displayReported {
+		return
+	}
+	sketch.displayReported = true
+	status.Error("/sketch/display", errors.Errorf("sketch %s can't open its display, configure it with /sketch/display/post", sketch.ID))
+}
+
+// SketchDisplayEvent reads or changes the display settings of a sketch,
+// and lists the graphical sessions found on the device
+func (status *Status) SketchDisplayEvent(client mqtt.Client, msg mqtt.Message) {
+	var info struct {
+		ID      string           `json:"id"`
+		Display *DisplaySettings `json:"display"`
+		Reset   bool             `json:"reset"`
+	}
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		status.Error("/sketch/display", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+
+	var response struct {
+		ID       string             `json:"id,omitempty"`
+		Display  *DisplaySettings   `json:"display,omitempty"`
+		Sessions []GraphicalSession `json:"sessions"`
+	}
+	response.Sessions = graphicalSessions()
+
+	if info.ID != "" {
+		sketch, ok := status.Sketches[info.ID]
+		if !ok {
+			status.Error("/sketch/display", errors.New("sketch "+info.ID+" not found"))
+			return
+		}
+		if info.Display != nil || info.Reset {
+			if info.Reset {
+				info.Display = nil
+			}
+			if err := saveDisplaySettings(info.ID, info.Display); err != nil {
+				status.Error("/sketch/display", errors.Wrapf(err, "save display settings of %s", info.ID))
+				return
+			}
+			// the settings are used the next time the sketch starts
+			sketch.Display = info.Display
+			status.Set(info.ID, sketch)
+		}
+		response.ID = info.ID
+		response.Display = displaySettingsFor(info.ID)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		status.Error("/sketch/display", errors.Wrap(err, "json marshal"))
+		return
+	}
+	status.Info("/sketch/display", string(data)+"\n")
+}
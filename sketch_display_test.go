@@ -0,0 +1,139 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetEnv(t *testing.T) {
+	tests := []struct {
+		env         []string
+		name, value string
+		result      []string
+	}{
+		{nil, "DISPLAY", ":0", []string{"DISPLAY=:0"}},
+		{[]string{"HOME=/root"}, "DISPLAY", ":0", []string{"HOME=/root", "DISPLAY=:0"}},
+		{[]string{"DISPLAY=:1", "HOME=/root"}, "DISPLAY", ":0", []string{"DISPLAY=:0", "HOME=/root"}},
+		{[]string{"DISPLAYS=:1"}, "DISPLAY", ":0", []string{"DISPLAYS=:1", "DISPLAY=:0"}},
+		{[]string{"XDISPLAY=:1"}, "DISPLAY", ":0", []string{"XDISPLAY=:1", "DISPLAY=:0"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.result, setEnv(test.env, test.name, test.value), test.name+" in %v", test.env)
+	}
+}
+
+func TestApplyDisplaySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings *DisplaySettings
+		env      []string
+		err      string
+	}{
+		{"no settings", nil, []string{"HOME=/root"}, ""},
+		{"x11", &DisplaySettings{Display: ":1", XAuthority: "/home/jane/.Xauthority"},
+			[]string{"HOME=/root", "DISPLAY=:1", "XAUTHORITY=/home/jane/.Xauthority"}, ""},
+		{"wayland", &DisplaySettings{WaylandDisplay: "wayland-0"}, []string{"HOME=/root", "WAYLAND_DISPLAY=wayland-0"}, ""},
+		{"unknown session", &DisplaySettings{Session: "no-such-session"}, []string{"HOME=/root"}, "no graphical session matching no-such-session found"},
+		{"session of an unknown user", &DisplaySettings{Session: "auto", User: "no-such-user"}, []string{"HOME=/root"}, "no graphical session matching auto found"},
+	}
+	for _, test := range tests {
+		cmd := exec.Command("true")
+		cmd.Env = []string{"HOME=/root"}
+		err := applyDisplaySettings(cmd, test.settings)
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+		} else {
+			assert.EqualError(t, err, test.err, test.name)
+		}
+		assert.ElementsMatch(t, test.env, cmd.Env, test.name)
+	}
+}
+
+func TestMissingDisplayReportedOnce(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	sketch := &SketchStatus{ID: "blink"}
+
+	checkSketchForMissingDisplayEnvVariable("segmentation fault", sketch, status)
+	assert.Empty(t, client.take())
+	checkSketchForMissingDisplayEnvVariable("Error: Can't open display: :0", sketch, status)
+	assert.Equal(t, []string{"$aws/things/dev/sketch/display ERROR: sketch blink can't open its display, configure it with /sketch/display/post\n"}, client.take())
+	checkSketchForMissingDisplayEnvVariable("cannot open display", sketch, status)
+	assert.Empty(t, client.take())
+}
+
+func TestSketchDisplayEvent(t *testing.T) {
+	client := &recordingClient{}
+	status := NewStatus("dev", client, nil)
+	id := "display-test"
+	status.Sketches[id] = &SketchStatus{ID: id, Name: "blink", Status: SketchStopped}
+	defer saveDisplaySettings(id, nil)
+
+	response := func() map[string]json.RawMessage {
+		var published []string
+		for _, message := range client.take() {
+			if !strings.HasPrefix(message, "/status ") {
+				published = append(published, message)
+			}
+		}
+		if !assert.Len(t, published, 1) {
+			return nil
+		}
+		prefix := "$aws/things/dev/sketch/display INFO: "
+		if !assert.True(t, strings.HasPrefix(published[0], prefix), published[0]) {
+			return nil
+		}
+		var result map[string]json.RawMessage
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(published[0], prefix)), &result))
+		return result
+	}
+
+	status.SketchDisplayEvent(client, payloadMessage{payload: `{"id": "fade"}`})
+	assert.Equal(t, []string{"$aws/things/dev/sketch/display ERROR: sketch fade not found\n"}, client.take())
+	status.SketchDisplayEvent(client, payloadMessage{payload: `not json`})
+	assert.Contains(t, client.take()[0], "ERROR: unmarshal not json")
+
+	// the sessions are always listed
+	status.SketchDisplayEvent(client, payloadMessage{payload: `{}`})
+	result := response()
+	assert.Contains(t, result, "sessions")
+	assert.NotContains(t, result, "id")
+
+	status.SketchDisplayEvent(client, payloadMessage{payload: `{"id": "display-test", "display": {"display": ":1", "user": "jane"}}`})
+	result = response()
+	assert.JSONEq(t, `"display-test"`, string(result["id"]))
+	assert.JSONEq(t, `{"display": ":1", "user": "jane"}`, string(result["display"]))
+	assert.Equal(t, &DisplaySettings{Display: ":1", User: "jane"}, status.Sketches[id].Display)
+	assert.Equal(t, &DisplaySettings{Display: ":1", User: "jane"}, displaySettingsFor(id))
+
+	// reading them doesn't change them
+	status.SketchDisplayEvent(client, payloadMessage{payload: `{"id": "display-test"}`})
+	assert.JSONEq(t, `{"display": ":1", "user": "jane"}`, string(response()["display"]))
+
+	status.SketchDisplayEvent(client, payloadMessage{payload: `{"id": "display-test", "reset": true}`})
+	assert.NotContains(t, response(), "display")
+	assert.Nil(t, status.Sketches[id].Display)
+	assert.Nil(t, displaySettingsFor(id))
+}
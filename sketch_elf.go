@@ -0,0 +1,278 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// elfMachines lists the ELF machines that can run on each architecture
+var elfMachines = map[string][]elf.Machine{
+	"386":     {elf.EM_386},
+	"amd64":   {elf.EM_X86_64, elf.EM_386},
+	"arm":     {elf.EM_ARM},
+	"arm64":   {elf.EM_AARCH64, elf.EM_ARM},
+	"mips":    {elf.EM_MIPS},
+	"mipsle":  {elf.EM_MIPS},
+	"ppc64le": {elf.EM_PPC64},
+}
+
+// errNotELF is returned when the sketch is not an ELF executable (eg. a script)
+var errNotELF = errors.New("not an ELF executable")
+
+// elfTarget is what the dynamic loader matches to pick the libraries of an
+// executable: a 32 bit x86 sketch can't use the x86-64 libraries of the device
+type elfTarget struct {
+	class   elf.Class
+	machine elf.Machine
+}
+
+// elfTargetOf returns the target of the ELF file at path
+func elfTargetOf(path string) (elfTarget, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return elfTarget{}, err
+	}
+	defer f.Close()
+	return elfTarget{f.Class, f.Machine}, nil
+}
+
+// elfDependencies checks that the executable at path can run on this machine
+// and returns its target, its DT_NEEDED libraries and its library search path (RPATH/RUNPATH)
+func elfDependencies(path string) (elfTarget, []string, []string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); ok {
+			return elfTarget{}, nil, nil, errNotELF
+		}
+		return elfTarget{}, nil, nil, err
+	}
+	defer f.Close()
+	target := elfTarget{f.Class, f.Machine}
+
+	compatible := false
+	for _, machine := range elfMachines[runtime.GOARCH] {
+		if f.Machine == machine {
+			compatible = true
+		}
+	}
+	if !compatible {
+		return elfTarget{}, nil, nil, errors.Errorf("the sketch is built for %s, this device is %s", f.Machine, runtime.GOARCH)
+	}
+
+	needed, err := f.ImportedLibraries()
+	if err != nil {
+		return elfTarget{}, nil, nil, errors.Wrap(err, "read DT_NEEDED")
+	}
+
+	var rpath []string
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		values, _ := f.DynString(tag)
+		for _, value := range values {
+			for _, dir := range filepath.SplitList(value) {
+				rpath = append(rpath, strings.Replace(dir, "$ORIGIN", filepath.Dir(path), -1))
+			}
+		}
+	}
+	return target, needed, rpath, nil
+}
+
+// libraryResolver finds shared libraries the way the dynamic loader would
+type libraryResolver struct {
+	dirs []string
+	// cache maps the libraries known to ldconfig to their paths, of any target
+	cache map[string][]string
+}
+
+// newLibraryResolver collects the folders searched by the dynamic loader,
+// the sketch lib folder and the libraries known to ldconfig
+func newLibraryResolver(extraDirs ...string) *libraryResolver {
+	r := &libraryResolver{cache: map[string][]string{}}
+	r.dirs = append(r.dirs, extraDirs...)
+	r.dirs = append(r.dirs, filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))...)
+	r.dirs = append(r.dirs, ldSoConfDirs("/etc/ld.so.conf")...)
+	r.dirs = append(r.dirs, "/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib")
+
+	out, err := exec.Command("ldconfig", "-p").Output()
+	if err != nil {
+		out, _ = exec.Command("/sbin/ldconfig", "-p").Output()
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// libfoo.so.1 (libc6,x86-64) => /usr/lib/x86_64-linux-gnu/libfoo.so.1
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[len(fields)-2] == "=>" {
+			r.cache[fields[0]] = append(r.cache[fields[0]], fields[len(fields)-1])
+		}
+	}
+	return r
+}
+
+// ldSoConfDirs parses an ld.so.conf file, following its include directives
+func ldSoConfDirs(conf string) []string {
+	file, err := os.Open(conf)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "include ") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include "))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(conf), pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, match := range matches {
+				dirs = append(dirs, ldSoConfDirs(match)...)
+			}
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs
+}
+
+// resolve returns the path of the library built for target, or an empty string if it
+// can't be found. Like the dynamic loader, it skips the libraries of other targets.
+func (r *libraryResolver) resolve(library string, target elfTarget, extraDirs []string) string {
+	dirs := append(append([]string{}, extraDirs...), r.dirs...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, library)
+		if found, err := elfTargetOf(path); err == nil && found == target {
+			return path
+		}
+	}
+	for _, path := range r.cache[library] {
+		if found, err := elfTargetOf(path); err == nil && found == target {
+			return path
+		}
+	}
+	return ""
+}
+
+// missingLibraries returns the libraries needed by the executable at path
+// (and by the libraries found in libFolders) that the dynamic loader can't find
+func missingLibraries(path string, libFolders ...string) ([]string, error) {
+	resolver := newLibraryResolver(libFolders...)
+
+	var missing []string
+	visited := map[string]bool{}
+	queue := []string{path}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		target, needed, rpath, err := elfDependencies(current)
+		if err != nil {
+			if current == path {
+				return nil, err
+			}
+			continue
+		}
+		for _, library := range needed {
+			if visited[library] {
+				continue
+			}
+			visited[library] = true
+			resolved := resolver.resolve(library, target, rpath)
+			if resolved == "" {
+				missing = append(missing, library)
+				continue
+			}
+			for _, libFolder := range libFolders {
+				if strings.HasPrefix(resolved, libFolder+string(filepath.Separator)) {
+					// libraries shipped with the sketches may need others in turn
+					queue = append(queue, resolved)
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// preflightSketch checks a sketch binary before it's started for the first time:
+// it must be built for this architecture and all its libraries must be available.
+// Missing libraries are looked up in the dylib registry and downloaded.
+// Sketches running in a container rely on the libraries of their image.
+func (status *Status) preflightSketch(id, path string) error {
+	if sketchContainerFor(id, nil) != nil {
+		return nil
+	}
+
+	folder, err := getSketchFolder()
+	if err != nil {
+		return err
+	}
+	libFolders := []string{filepath.Join(folder, "lib")}
+
+	if isBundle(path) {
+		bundle, manifest, err := prepareBundle(path, false)
+		if err != nil {
+			return err
+		}
+		if manifest.Interpreter != "" || manifest.Container != nil {
+			return nil
+		}
+		path = filepath.Join(bundle, manifest.Entrypoint)
+		if manifest.Lib != "" {
+			libFolders = append(libFolders, filepath.Join(bundle, manifest.Lib))
+		}
+	}
+
+	missing, err := missingLibraries(path, libFolders...)
+	if err == errNotELF {
+		// scripts are run by their interpreter
+		return nil
+	}
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	status.Info("/upload", "Downloading needed libraries: "+strings.Join(missing, ", "))
+	var downloadErrors []string
+	for _, library := range missing {
+		if err := downloadDylibDependencies(library, status.config); err != nil {
+			downloadErrors = append(downloadErrors, err.Error())
+		}
+	}
+
+	missing, err = missingLibraries(path, libFolders...)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New("missing libraries " + strings.Join(missing, ", ") + " (" + strings.Join(downloadErrors, "; ") +
+			"), install them and upload the sketch again")
+	}
+	return nil
+}
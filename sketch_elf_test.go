@@ -0,0 +1,182 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestELF writes a little endian ELF file for target with nothing but a
+// dynamic section listing the needed libraries
+func writeTestELF(t *testing.T, path string, target elfTarget, needed ...string) {
+	dynstr := "\x00" + strings.Join(needed, "\x00") + "\x00"
+	shstrtab := "\x00.dynstr\x00.dynamic\x00.shstrtab\x00"
+	var dynamic bytes.Buffer
+	offset := 1
+	for _, library := range needed {
+		writeDyn(&dynamic, target.class, elf.DT_NEEDED, uint64(offset))
+		offset += len(library) + 1
+	}
+	writeDyn(&dynamic, target.class, elf.DT_NULL, 0)
+
+	headerSize, sectionSize := 64, 64
+	if target.class == elf.ELFCLASS32 {
+		headerSize, sectionSize = 52, 40
+	}
+	dynstrOffset := headerSize
+	dynamicOffset := dynstrOffset + len(dynstr)
+	shstrtabOffset := dynamicOffset + dynamic.Len()
+	sectionsOffset := shstrtabOffset + len(shstrtab)
+	sections := []struct {
+		name, kind, offset, size, link int
+	}{
+		{},
+		{1, int(elf.SHT_STRTAB), dynstrOffset, len(dynstr), 0},
+		{9, int(elf.SHT_DYNAMIC), dynamicOffset, dynamic.Len(), 1},
+		{18, int(elf.SHT_STRTAB), shstrtabOffset, len(shstrtab), 0},
+	}
+
+	var out bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(target.class), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	if target.class == elf.ELFCLASS32 {
+		binary.Write(&out, binary.LittleEndian, elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_DYN), Machine: uint16(target.machine), Version: uint32(elf.EV_CURRENT),
+			Shoff: uint32(sectionsOffset), Ehsize: uint16(headerSize), Shentsize: uint16(sectionSize),
+			Shnum: uint16(len(sections)), Shstrndx: 3,
+		})
+	} else {
+		binary.Write(&out, binary.LittleEndian, elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_DYN), Machine: uint16(target.machine), Version: uint32(elf.EV_CURRENT),
+			Shoff: uint64(sectionsOffset), Ehsize: uint16(headerSize), Shentsize: uint16(sectionSize),
+			Shnum: uint16(len(sections)), Shstrndx: 3,
+		})
+	}
+	out.WriteString(dynstr)
+	out.Write(dynamic.Bytes())
+	out.WriteString(shstrtab)
+	for _, s := range sections {
+		if target.class == elf.ELFCLASS32 {
+			binary.Write(&out, binary.LittleEndian, elf.Section32{
+				Name: uint32(s.name), Type: uint32(s.kind), Off: uint32(s.offset), Size: uint32(s.size), Link: uint32(s.link),
+			})
+		} else {
+			binary.Write(&out, binary.LittleEndian, elf.Section64{
+				Name: uint32(s.name), Type: uint32(s.kind), Off: uint64(s.offset), Size: uint64(s.size), Link: uint32(s.link),
+			})
+		}
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeDyn(out *bytes.Buffer, class elf.Class, tag elf.DynTag, value uint64) {
+	if class == elf.ELFCLASS32 {
+		binary.Write(out, binary.LittleEndian, elf.Dyn32{Tag: int32(tag), Val: uint32(value)})
+		return
+	}
+	binary.Write(out, binary.LittleEndian, elf.Dyn64{Tag: int64(tag), Val: value})
+}
+
+func TestMissingLibraries(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the fixtures are x86 executables")
+	}
+	folder, err := ioutil.TempDir("", "elf")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+	lib32 := filepath.Join(folder, "lib32")
+	lib64 := filepath.Join(folder, "lib64")
+	os.Mkdir(lib32, 0700)
+	os.Mkdir(lib64, 0700)
+
+	x86 := elfTarget{elf.ELFCLASS32, elf.EM_386}
+	x8664 := elfTarget{elf.ELFCLASS64, elf.EM_X86_64}
+	sketch64 := filepath.Join(folder, "sketch64")
+	sketch32 := filepath.Join(folder, "sketch32")
+	writeTestELF(t, sketch64, x8664, "libarduinotest.so.1")
+	writeTestELF(t, sketch32, x86, "libarduinotest.so.1")
+
+	// the libraries of the other class are skipped, even when they come first
+	writeTestELF(t, filepath.Join(lib32, "libarduinotest.so.1"), x86)
+	missing, err := missingLibraries(sketch64, lib32, lib64)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"libarduinotest.so.1"}, missing)
+	missing, err = missingLibraries(sketch32, lib32, lib64)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// the libraries shipped with the sketch are checked in turn
+	writeTestELF(t, filepath.Join(lib64, "libarduinotest.so.1"), x8664, "libarduinotestdep.so.2")
+	missing, err = missingLibraries(sketch64, lib32, lib64)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"libarduinotestdep.so.2"}, missing)
+
+	// so is the machine
+	writeTestELF(t, filepath.Join(lib64, "libarduinotestdep.so.2"), elfTarget{elf.ELFCLASS64, elf.EM_AARCH64})
+	missing, err = missingLibraries(sketch64, lib32, lib64)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"libarduinotestdep.so.2"}, missing)
+	writeTestELF(t, filepath.Join(lib64, "libarduinotestdep.so.2"), x8664)
+	missing, err = missingLibraries(sketch64, lib32, lib64)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// sketches for other machines and scripts
+	arm := filepath.Join(folder, "arm")
+	writeTestELF(t, arm, elfTarget{elf.ELFCLASS32, elf.EM_ARM})
+	_, err = missingLibraries(arm)
+	assert.EqualError(t, err, "the sketch is built for EM_ARM, this device is amd64")
+	script := filepath.Join(folder, "script")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0700)
+	_, err = missingLibraries(script)
+	assert.Equal(t, errNotELF, err)
+}
+
+func TestResolveLdconfigCache(t *testing.T) {
+	folder, err := ioutil.TempDir("", "elf")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+	x86 := elfTarget{elf.ELFCLASS32, elf.EM_386}
+	x8664 := elfTarget{elf.ELFCLASS64, elf.EM_X86_64}
+	lib32 := filepath.Join(folder, "libarduinotest32.so.1")
+	lib64 := filepath.Join(folder, "libarduinotest64.so.1")
+	writeTestELF(t, lib32, x86)
+	writeTestELF(t, lib64, x8664)
+
+	resolver := &libraryResolver{cache: map[string][]string{"libarduinotest.so.1": {lib32, lib64}}}
+	assert.Equal(t, lib32, resolver.resolve("libarduinotest.so.1", x86, nil))
+	assert.Equal(t, lib64, resolver.resolve("libarduinotest.so.1", x8664, nil))
+	assert.Equal(t, "", resolver.resolve("libarduinotest.so.1", elfTarget{elf.ELFCLASS64, elf.EM_AARCH64}, nil))
+	assert.Equal(t, "", resolver.resolve("libmissing.so.1", x8664, nil))
+}
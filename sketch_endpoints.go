@@ -0,0 +1,208 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nats "github.com/nats-io/go-nats"
+	"github.com/pkg/errors"
+)
+
+// Sketches register their callable functions publishing on $arduino.sketch.<sketch id>.endpoints.register
+// (or unregister), the subject tells which sketch it is, and serve the calls on
+// $arduino.endpoints.<sketch id>.<endpoint name>
+const (
+	defaultEndpointCallTimeout = 5 * time.Second
+	maxEndpointCallTimeout     = time.Minute
+)
+
+// EndpointRegistration is sent by a sketch to expose (or remove) a function
+type EndpointRegistration struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// subjectToken replaces the characters that can't be part of a NATS subject token
+func subjectToken(s string) string {
+	return strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_", "\t", "_").Replace(s)
+}
+
+// claimSketchToken reserves the subject token of the sketch id: the subjects, the NATS
+// user and the container of a sketch are named after it, two sketches can't share it
+func (s *Status) claimSketchToken(id string) error {
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	token := subjectToken(id)
+	if other, ok := s.sketchTokens[token]; ok && other != id {
+		return errors.Errorf("sketch %s can't be started, its id is too similar to the one of sketch %s", id, other)
+	}
+	s.sketchTokens[token] = id
+	return nil
+}
+
+// releaseSketchToken frees the subject token of a deleted sketch
+func (s *Status) releaseSketchToken(id string) {
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+	if token := subjectToken(id); s.sketchTokens[token] == id {
+		delete(s.sketchTokens, token)
+	}
+}
+
+// sketchByToken returns the sketch that claimed the subject token
+func (s *Status) sketchByToken(token string) *SketchStatus {
+	s.tokensMutex.Lock()
+	id, ok := s.sketchTokens[token]
+	s.tokensMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.Sketches[id]
+}
+
+func endpointSubject(sketchID, name string) string {
+	return "$arduino.endpoints." + subjectToken(sketchID) + "." + subjectToken(name)
+}
+
+// endpointsRegistrationSubject is where a sketch registers (or unregisters, with
+// action "*" for both) its endpoints
+func endpointsRegistrationSubject(sketchID, action string) string {
+	return "$arduino.sketch." + sketchID + ".endpoints." + action
+}
+
+// subscribeEndpoints listens to the registrations of the sketch endpoints
+func (s *Status) subscribeEndpoints(nc *nats.Conn) {
+	nc.Subscribe(endpointsRegistrationSubject("*", "register"), s.endpointRegistrationCB(true))
+	nc.Subscribe(endpointsRegistrationSubject("*", "unregister"), s.endpointRegistrationCB(false))
+}
+
+func (s *Status) endpointRegistrationCB(register bool) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		// $arduino.sketch.<sketch id>.endpoints.<action>
+		token := strings.Split(m.Subject, ".")[2]
+		err := s.registerEndpoint(token, m.Data, register)
+		if m.Reply == "" {
+			return
+		}
+		if err != nil {
+			s.natsClient.Publish(m.Reply, []byte("ERROR: "+err.Error()))
+			return
+		}
+		s.natsClient.Publish(m.Reply, []byte("OK"))
+	}
+}
+
+// registerEndpoint updates the endpoints of the sketch whose id, as a subject token, is token
+func (s *Status) registerEndpoint(token string, data []byte, register bool) error {
+	var reg EndpointRegistration
+	if err := json.Unmarshal(data, &reg); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", data)
+	}
+	if reg.Name == "" {
+		return errors.New("missing endpoint name")
+	}
+	sketch := s.sketchByToken(token)
+	if sketch == nil {
+		return errors.New("sketch " + token + " not found")
+	}
+
+	sketch.mutex.Lock()
+	endpoints := []Endpoint{}
+	for _, e := range sketch.Endpoints {
+		if e.Name != reg.Name {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if register {
+		endpoints = append(endpoints, Endpoint{Name: reg.Name, Arguments: reg.Arguments})
+	}
+	sketch.Endpoints = endpoints
+	sketch.mutex.Unlock()
+
+	s.Set(sketch.ID, sketch)
+	s.Publish()
+	return nil
+}
+
+// SketchCallEvent invokes a function exposed by a running sketch and replies with its result
+func (s *Status) SketchCallEvent(client mqtt.Client, msg mqtt.Message) {
+	var info struct {
+		ID        string          `json:"id"`
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+		Timeout   int             `json:"timeout"` // milliseconds
+	}
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		s.Error("/sketch/call", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+
+	sketch, ok := s.Sketches[info.ID]
+	if !ok || sketch == nil {
+		s.Error("/sketch/call", errors.New("sketch "+info.ID+" not found"))
+		return
+	}
+	found := false
+	sketch.mutex.Lock()
+	for _, e := range sketch.Endpoints {
+		if e.Name == info.Name {
+			found = true
+		}
+	}
+	sketch.mutex.Unlock()
+	if !found {
+		s.Error("/sketch/call", errors.New("sketch "+info.ID+" doesn't expose "+info.Name))
+		return
+	}
+	if s.natsClient == nil {
+		s.Error("/sketch/call", errors.New("NATS not available"))
+		return
+	}
+
+	timeout := time.Duration(info.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultEndpointCallTimeout
+	}
+	if timeout > maxEndpointCallTimeout {
+		timeout = maxEndpointCallTimeout
+	}
+
+	reply, err := natsRequest(s.natsClient, endpointSubject(info.ID, info.Name), info.Arguments, timeout)
+	if err != nil {
+		s.Error("/sketch/call", errors.Wrapf(err, "call %s on %s", info.Name, info.ID))
+		return
+	}
+
+	result := struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Reply string `json:"reply"`
+	}{info.ID, info.Name, string(reply.Data)}
+	data, err := json.Marshal(result)
+	if err != nil {
+		s.Error("/sketch/call", errors.Wrap(err, "json marshal result"))
+		return
+	}
+	s.Info("/sketch/call", string(data)+"\n")
+}
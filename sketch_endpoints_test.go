@@ -0,0 +1,90 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchTokens(t *testing.T) {
+	status := NewStatus("dev", nil, nil)
+	for _, id := range []string{"a.b", "a_b", "a b", "blink", "a*b"} {
+		status.Sketches[id] = &SketchStatus{ID: id, Name: id, Status: SketchStopped}
+	}
+
+	tests := []struct {
+		claim string
+		err   string
+	}{
+		{"a.b", ""},
+		{"a.b", ""},
+		{"a_b", "too similar to the one of sketch a.b"},
+		{"a b", "too similar to the one of sketch a.b"},
+		{"blink", ""},
+	}
+	for _, test := range tests {
+		err := status.claimSketchToken(test.claim)
+		if test.err == "" {
+			assert.NoError(t, err, test.claim)
+		} else if assert.Error(t, err, test.claim) {
+			assert.Contains(t, err.Error(), test.err, test.claim)
+		}
+	}
+
+	resolved := []struct {
+		token string
+		id    string
+	}{
+		{"a_b", "a.b"},
+		{"blink", "blink"},
+		{"a.b", ""},
+		{"other", ""},
+	}
+	for _, test := range resolved {
+		sketch := status.sketchByToken(test.token)
+		if test.id == "" {
+			assert.Nil(t, sketch, test.token)
+		} else if assert.NotNil(t, sketch, test.token) {
+			assert.Equal(t, test.id, sketch.ID, test.token)
+		}
+	}
+
+	// the endpoints always go to the sketch that claimed the token
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, status.registerEndpoint("a_b", []byte(`{"name": "blink"}`), true))
+	}
+	assert.Len(t, status.Sketches["a.b"].Endpoints, 1)
+	assert.Empty(t, status.Sketches["a_b"].Endpoints)
+	assert.Empty(t, status.Sketches["a b"].Endpoints)
+	assert.EqualError(t, status.registerEndpoint("other", []byte(`{"name": "blink"}`), true), "sketch other not found")
+
+	// a colliding sketch doesn't start, until the other one is deleted
+	err := status.startSketch(status.Sketches["a*b"])
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too similar")
+	}
+	assert.Equal(t, SketchStopped, status.Sketches["a*b"].Status)
+	status.releaseSketchToken("a_b")
+	assert.NotNil(t, status.sketchByToken("a_b"))
+	status.releaseSketchToken("a.b")
+	assert.Nil(t, status.sketchByToken("a_b"))
+	assert.NoError(t, status.claimSketchToken("a_b"))
+}
@@ -0,0 +1,321 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// States of a sketch
+const (
+	SketchStopped  = "STOPPED"
+	SketchStarting = "STARTING"
+	SketchRunning  = "RUNNING"
+	SketchPaused   = "PAUSED"
+	SketchStopping = "STOPPING"
+	SketchCrashed  = "CRASHED"
+	SketchDeleted  = "DELETED"
+)
+
+// sketchTransitions lists the states a sketch can go to from each state
+var sketchTransitions = map[string][]string{
+	SketchStopped:  {SketchStarting, SketchDeleted},
+	SketchStarting: {SketchRunning, SketchCrashed},
+	SketchRunning:  {SketchPaused, SketchStopping, SketchStopped, SketchCrashed},
+	SketchPaused:   {SketchRunning, SketchStopping, SketchStopped, SketchCrashed},
+	SketchStopping: {SketchStopped},
+	SketchCrashed:  {SketchStarting, SketchStopped, SketchDeleted},
+	SketchDeleted:  {},
+}
+
+// SketchStateChange is published on /sketch/state every time a sketch changes state
+type SketchStateChange struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// setSketchState moves the sketch to a new state, if the transition is allowed.
+// The caller must hold the sketch mutex.
+func (status *Status) setSketchState(sketch *SketchStatus, state, reason string) error {
+	from := sketch.Status
+	if from == "" {
+		from = SketchStopped
+	}
+	allowed := false
+	for _, to := range sketchTransitions[from] {
+		if to == state {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return errors.Errorf("sketch %s is %s, it can't become %s", sketch.ID, from, state)
+	}
+	sketch.Status = state
+
+	change := SketchStateChange{ID: sketch.ID, Name: sketch.Name, From: from, To: state, Reason: reason, Time: time.Now()}
+	data, err := json.Marshal(change)
+	if err == nil {
+		status.Info("/sketch/state", string(data))
+	}
+	status.Event("sketch."+strings.ToLower(state), change)
+	return nil
+}
+
+// applyAction performs a sketch action received from the cloud or from the connector itself
+func applyAction(sketch *SketchStatus, action string, status *Status) error {
+	switch action {
+	case "START":
+		return status.startSketch(sketch)
+	case "STOP":
+		_, err := status.stopSketch(sketch)
+		return err
+	case "PAUSE":
+		return status.pauseSketch(sketch)
+	case "RESUME":
+		return status.resumeSketch(sketch)
+	case "DELETE":
+		return status.deleteSketch(sketch)
+	}
+	return errors.Errorf("unknown action %s", action)
+}
+
+// startSketch spawns a stopped sketch. A paused sketch is resumed instead.
+func (status *Status) startSketch(sketch *SketchStatus) error {
+	sketch.mutex.Lock()
+	defer sketch.mutex.Unlock()
+
+	if sketch.Status == SketchPaused {
+		return status.signalSketch(sketch, syscall.SIGCONT, SketchRunning)
+	}
+	if err := status.claimSketchToken(sketch.ID); err != nil {
+		return err
+	}
+
+	folder, err := getSketchFolder()
+	if err != nil {
+		return err
+	}
+	if err := status.setSketchState(sketch, SketchStarting, ""); err != nil {
+		return err
+	}
+	pid, _, _, err := spawnProcess(filepath.Join(folder, sketch.Name), sketch, status)
+	if err != nil {
+		status.setSketchState(sketch, SketchCrashed, err.Error())
+		return err
+	}
+	sketch.PID = pid
+	return status.setSketchState(sketch, SketchRunning, "")
+}
+
+// stopSignals are the signals that can be configured to stop sketches
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// parseStopSignal returns the signal named name (SIGTERM if empty)
+func parseStopSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	signal, ok := stopSignals[name]
+	if !ok {
+		return syscall.SIGTERM, errors.New("unsupported stop signal " + name)
+	}
+	return signal, nil
+}
+
+// stopSketch asks the sketch to exit with the configured signal and kills its
+// process group if it's still running after the grace period.
+// It returns "graceful" or "forced".
+func (status *Status) stopSketch(sketch *SketchStatus) (string, error) {
+	sketch.mutex.Lock()
+	// an explicit stop ends the probation of a new upload
+	sketch.endProbation()
+	if sketch.Status == SketchCrashed {
+		err := status.setSketchState(sketch, SketchStopped, "")
+		sketch.mutex.Unlock()
+		return "graceful", err
+	}
+	paused := sketch.Status == SketchPaused
+	if err := status.setSketchState(sketch, SketchStopping, ""); err != nil {
+		sketch.mutex.Unlock()
+		return "", err
+	}
+	process, group, done, containerID := sketch.process, sketch.group, sketch.done, sketch.container
+	sketch.mutex.Unlock()
+
+	result := "graceful"
+	if process != nil {
+		signal, err := parseStopSignal(status.config.SketchStopSignal)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if paused {
+			// a stopped process doesn't handle signals until it continues
+			status.killSketch(containerID, group, syscall.SIGCONT)
+		}
+		status.killSketch(containerID, group, signal)
+
+		select {
+		case <-done:
+		case <-time.After(status.config.SketchStopTimeout):
+			fmt.Println("kill called")
+			result = "forced"
+			status.killSketch(containerID, group, syscall.SIGKILL)
+			<-done
+		}
+	}
+
+	sketch.mutex.Lock()
+	defer sketch.mutex.Unlock()
+	sketch.process = nil
+	sketch.group = nil
+	sketch.container = ""
+	sketch.PID = 0
+	sketch.Endpoints = nil
+	return result, status.setSketchState(sketch, SketchStopped, "stopped ("+result+")")
+}
+
+// stopSketchIfActive stops the sketch unless it's already stopped
+func (status *Status) stopSketchIfActive(sketch *SketchStatus) error {
+	sketch.mutex.Lock()
+	state := sketch.Status
+	sketch.mutex.Unlock()
+	if state == "" || state == SketchStopped || state == SketchDeleted {
+		return nil
+	}
+	_, err := status.stopSketch(sketch)
+	return err
+}
+
+// pauseSketch suspends the sketch with SIGSTOP, which can't be ignored
+func (status *Status) pauseSketch(sketch *SketchStatus) error {
+	sketch.mutex.Lock()
+	defer sketch.mutex.Unlock()
+	if sketch.Status != SketchRunning {
+		return errors.Errorf("sketch %s is %s, it can't be paused", sketch.ID, sketch.Status)
+	}
+	return status.signalSketch(sketch, syscall.SIGSTOP, SketchPaused)
+}
+
+// resumeSketch continues a paused sketch
+func (status *Status) resumeSketch(sketch *SketchStatus) error {
+	sketch.mutex.Lock()
+	defer sketch.mutex.Unlock()
+	if sketch.Status != SketchPaused {
+		return errors.Errorf("sketch %s is %s, it can't be resumed", sketch.ID, sketch.Status)
+	}
+	return status.signalSketch(sketch, syscall.SIGCONT, SketchRunning)
+}
+
+// signalSketch sends a signal to the processes spawned for the sketch (never to a
+// reused PID) and moves the sketch to state. The caller must hold the sketch mutex.
+func (status *Status) signalSketch(sketch *SketchStatus, signal syscall.Signal, state string) error {
+	if sketch.process == nil {
+		return errors.Errorf("sketch %s has no process", sketch.ID)
+	}
+	// the whole process group (or container), children included
+	if err := status.killSketch(sketch.container, sketch.group, signal); err != nil {
+		return err
+	}
+	return status.setSketchState(sketch, state, "")
+}
+
+// deleteSketch stops the sketch and removes it from the device
+func (status *Status) deleteSketch(sketch *SketchStatus) error {
+	if err := status.stopSketchIfActive(sketch); err != nil {
+		return err
+	}
+
+	sketch.mutex.Lock()
+	defer sketch.mutex.Unlock()
+	if err := status.setSketchState(sketch, SketchDeleted, ""); err != nil {
+		return err
+	}
+	fmt.Println("delete called")
+	sketchFolder, err := getSketchFolder()
+	if err == nil {
+		err = os.Remove(filepath.Join(sketchFolder, sketch.Name))
+	}
+	if err != nil {
+		fmt.Println("error deleting sketch")
+	}
+	if status.Sketches[sketch.ID] == sketch {
+		delete(status.Sketches, sketch.ID)
+	}
+	status.releaseSketchToken(sketch.ID)
+	status.nats.revokeSketch(sketch.ID)
+	return nil
+}
+
+// sketchExited updates the sketch when its process ends
+func (status *Status) sketchExited(sketch *SketchStatus, process *os.Process, exitErr error) {
+	sketch.mutex.Lock()
+	if sketch.process != process || sketch.Status == SketchStopping {
+		// stopSketch takes care of it, or a new process has already been spawned
+		sketch.mutex.Unlock()
+		return
+	}
+	sketch.process = nil
+	sketch.group = nil
+	sketch.container = ""
+	sketch.PID = 0
+	sketch.Endpoints = nil
+
+	rollback := sketch.failedProbation()
+	if !rollback {
+		sketch.endProbation()
+	}
+	state, reason := SketchStopped, "exited"
+	if exitErr != nil {
+		state, reason = SketchCrashed, exitErr.Error()
+	}
+	status.setSketchState(sketch, state, reason)
+	sketch.mutex.Unlock()
+
+	if rollback {
+		status.rollbackSketch(sketch)
+		return
+	}
+	if status.Sketches[sketch.ID] == sketch {
+		status.Publish()
+	}
+}
@@ -0,0 +1,280 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// longer lines are not parsed
+const maxTelemetryLine = 4096
+
+// TelemetrySettings tells how to extract properties from the output of a sketch
+type TelemetrySettings struct {
+	// Mode is json (one object per line), kv (key=value pairs) or regex (named groups)
+	Mode    string `json:"mode"`
+	Pattern string `json:"pattern,omitempty"`
+	// Prefix is prepended to the name of the properties
+	Prefix string `json:"prefix,omitempty"`
+	// Properties, if not empty, are the only ones published
+	Properties []string `json:"properties,omitempty"`
+	// NATS also publishes the properties on $arduino.telemetry.<sketch id>.<property>
+	NATS bool `json:"nats,omitempty"`
+}
+
+// telemetryParser extracts properties from the lines printed by a sketch
+type telemetryParser struct {
+	settings TelemetrySettings
+	pattern  *regexp.Regexp
+	allowed  map[string]bool
+
+	mutex   sync.Mutex
+	partial []byte
+}
+
+var kvPair = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_.\-]*)=("[^"]*"|[^\s,;]*)`)
+
+func newTelemetryParser(settings TelemetrySettings) (*telemetryParser, error) {
+	p := &telemetryParser{settings: settings}
+	switch settings.Mode {
+	case "json", "kv":
+	case "regex":
+		pattern, err := regexp.Compile(settings.Pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "telemetry pattern")
+		}
+		hasNames := false
+		for _, name := range pattern.SubexpNames() {
+			hasNames = hasNames || name != ""
+		}
+		if !hasNames {
+			return nil, errors.New("the telemetry pattern has no named groups")
+		}
+		p.pattern = pattern
+	default:
+		return nil, errors.Errorf("unknown telemetry mode %s", settings.Mode)
+	}
+	if len(settings.Properties) > 0 {
+		p.allowed = map[string]bool{}
+		for _, name := range settings.Properties {
+			p.allowed[name] = true
+		}
+	}
+	return p, nil
+}
+
+// typedValue turns a textual value into a number, a boolean or a string
+func typedValue(value string) interface{} {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	if b, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+		return b
+	}
+	return value
+}
+
+// parseLine returns the properties found in a line, nil if it doesn't match
+func (p *telemetryParser) parseLine(line string) map[string]interface{} {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	properties := map[string]interface{}{}
+	switch p.settings.Mode {
+	case "json":
+		if !strings.HasPrefix(line, "{") {
+			return nil
+		}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&properties); err != nil {
+			return nil
+		}
+	case "kv":
+		for _, match := range kvPair.FindAllStringSubmatch(line, -1) {
+			properties[match[1]] = typedValue(match[2])
+		}
+	case "regex":
+		match := p.pattern.FindStringSubmatch(line)
+		if match == nil {
+			return nil
+		}
+		for i, name := range p.pattern.SubexpNames() {
+			if name != "" && i < len(match) {
+				properties[name] = typedValue(match[i])
+			}
+		}
+	}
+
+	published := map[string]interface{}{}
+	for name, value := range properties {
+		if p.allowed != nil && !p.allowed[name] {
+			continue
+		}
+		published[p.settings.Prefix+name] = value
+	}
+	if len(published) == 0 {
+		return nil
+	}
+	return published
+}
+
+// feed collects the output of the sketch and returns the properties of the complete lines
+func (p *telemetryParser) feed(data []byte) []map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var updates []map[string]interface{}
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(p.partial[:i])
+		p.partial = p.partial[i+1:]
+		if properties := p.parseLine(line); properties != nil {
+			updates = append(updates, properties)
+		}
+	}
+	if len(p.partial) > maxTelemetryLine {
+		p.partial = nil
+	}
+	return updates
+}
+
+// telemetryParserFor returns the parser configured for a sketch, nil if it has none
+func (status *Status) telemetryParserFor(id string) *telemetryParser {
+	settings := map[string]TelemetrySettings{}
+	if err := loadSketchSettings("telemetry", &settings); err != nil {
+		return nil
+	}
+	config, ok := settings[id]
+	if !ok {
+		return nil
+	}
+	parser, err := newTelemetryParser(config)
+	if err != nil {
+		status.Error("/sketch/telemetry", errors.Wrapf(err, "telemetry of %s", id))
+		return nil
+	}
+	return parser
+}
+
+// extractTelemetry publishes the properties found in the output of a sketch
+func (status *Status) extractTelemetry(sketch *SketchStatus, data []byte) {
+	sketch.mutex.Lock()
+	parser := sketch.telemetry
+	sketch.mutex.Unlock()
+	if parser == nil {
+		return
+	}
+	for _, properties := range parser.feed(data) {
+		reported := map[string]json.RawMessage{}
+		for name, value := range properties {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				continue
+			}
+			reported[name] = encoded
+			if parser.settings.NATS && status.natsClient != nil {
+				status.natsClient.Publish("$arduino.telemetry."+subjectToken(sketch.ID)+"."+subjectToken(name), encoded)
+			}
+		}
+		if err := status.publishReported(reported, true); err != nil {
+			status.Error("/sketch/telemetry", errors.Wrapf(err, "telemetry of %s", sketch.ID))
+		}
+	}
+}
+
+// SketchTelemetryEvent configures the telemetry extracted from the output of a sketch
+func (status *Status) SketchTelemetryEvent(client mqtt.Client, msg mqtt.Message) {
+	var info struct {
+		ID        string             `json:"id"`
+		Telemetry *TelemetrySettings `json:"telemetry"`
+		Reset     bool               `json:"reset"`
+	}
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		status.Error("/sketch/telemetry", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	sketch, ok := status.Sketches[info.ID]
+	if !ok {
+		status.Error("/sketch/telemetry", errors.New("sketch "+info.ID+" not found"))
+		return
+	}
+
+	settings := map[string]TelemetrySettings{}
+	if err := loadSketchSettings("telemetry", &settings); err != nil {
+		status.Error("/sketch/telemetry", errors.Wrap(err, "read telemetry settings"))
+		return
+	}
+	if info.Telemetry != nil || info.Reset {
+		if info.Reset {
+			delete(settings, info.ID)
+			sketch.mutex.Lock()
+			sketch.telemetry = nil
+			sketch.mutex.Unlock()
+		} else {
+			parser, err := newTelemetryParser(*info.Telemetry)
+			if err != nil {
+				status.Error("/sketch/telemetry", err)
+				return
+			}
+			settings[info.ID] = *info.Telemetry
+			// applied right away, no need to restart the sketch
+			sketch.mutex.Lock()
+			sketch.telemetry = parser
+			sketch.mutex.Unlock()
+		}
+		if err := saveSketchSettings("telemetry", settings); err != nil {
+			status.Error("/sketch/telemetry", errors.Wrap(err, "save telemetry settings"))
+			return
+		}
+	}
+
+	var response struct {
+		ID        string             `json:"id"`
+		Telemetry *TelemetrySettings `json:"telemetry"`
+	}
+	response.ID = info.ID
+	if current, ok := settings[info.ID]; ok {
+		response.Telemetry = &current
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		status.Error("/sketch/telemetry", errors.Wrap(err, "json marshal"))
+		return
+	}
+	status.Info("/sketch/telemetry", string(data)+"\n")
+}
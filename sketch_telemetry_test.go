@@ -0,0 +1,54 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTelemetryParser(t *testing.T) {
+	kv, err := newTelemetryParser(TelemetrySettings{Mode: "kv", Prefix: "gh_"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"gh_temp": 21.5, "gh_door": "open", "gh_on": true},
+		kv.parseLine(`temp=21.5, door="open" on=true`))
+	assert.Nil(t, kv.parseLine("starting up"))
+
+	js, err := newTelemetryParser(TelemetrySettings{Mode: "json", Properties: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"temp": json.Number("21.5")}, js.parseLine(`{"temp": 21.5, "hum": 40}`))
+	assert.Nil(t, js.parseLine(`{"hum": 40}`))
+	assert.Nil(t, js.parseLine(`{broken`))
+
+	re, err := newTelemetryParser(TelemetrySettings{Mode: "regex", Pattern: `T:(?P<temp>[\d.]+) (?P<unit>\w)`})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"temp": 21.5, "unit": "C"}, re.parseLine("T:21.5 C"))
+
+	_, err = newTelemetryParser(TelemetrySettings{Mode: "regex", Pattern: `T:([\d.]+)`})
+	assert.Error(t, err)
+	_, err = newTelemetryParser(TelemetrySettings{Mode: "xml"})
+	assert.Error(t, err)
+
+	// lines split across reads
+	assert.Empty(t, kv.feed([]byte("temp=2")))
+	updates := kv.feed([]byte("1\nhum=4"))
+	assert.Equal(t, []map[string]interface{}{{"gh_temp": 21.0}}, updates)
+}
@@ -0,0 +1,377 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// SketchVersion describes a binary uploaded for a sketch
+type SketchVersion struct {
+	SHA256     string    `json:"sha256"`
+	Name       string    `json:"name"`
+	URL        string    `json:"url"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// SketchVersions is the history of the binaries of a sketch, newest first
+type SketchVersions struct {
+	ID       string          `json:"id"`
+	Active   string          `json:"active"`
+	Versions []SketchVersion `json:"versions"`
+}
+
+// unsafeIDChars were replaced in the folder names of the first histories
+var unsafeIDChars = regexp.MustCompile(`[^A-Za-z0-9._:-]`)
+
+// sketchVersionsFolderName is the folder of the history of the sketch id:
+// the hex encoded sha256 of the id, which any id can be a folder name of
+// without colliding with another one
+func sketchVersionsFolderName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func getSketchVersionsFolder(id string) (string, error) {
+	versionsFolder, err := getSketchSubFolder("versions")
+	if err != nil {
+		return "", err
+	}
+	folder := filepath.Join(versionsFolder, sketchVersionsFolderName(id))
+	if _, err := os.Stat(folder); os.IsNotExist(err) {
+		// move the history kept under its former name, if it's really the one of this sketch
+		legacy := filepath.Join(versionsFolder, unsafeIDChars.ReplaceAllString(id, "_"))
+		history := &SketchVersions{}
+		if raw, err := ioutil.ReadFile(filepath.Join(legacy, "versions.json")); err == nil && json.Unmarshal(raw, history) == nil && history.ID == id {
+			if err := os.Rename(legacy, folder); err == nil {
+				return folder, nil
+			}
+		}
+		err = os.Mkdir(folder, 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+	return folder, nil
+}
+
+func loadSketchVersions(id string) (*SketchVersions, string, error) {
+	folder, err := getSketchVersionsFolder(id)
+	if err != nil {
+		return nil, "", err
+	}
+	history := &SketchVersions{ID: id, Versions: []SketchVersion{}}
+	raw, err := ioutil.ReadFile(filepath.Join(folder, "versions.json"))
+	if err == nil {
+		json.Unmarshal(raw, history)
+	}
+	return history, folder, nil
+}
+
+func (h *SketchVersions) save(folder string) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, "versions.json"), data, 0600)
+}
+
+// find returns the version matching the given sha256 or any unique prefix of it
+func (h *SketchVersions) find(sha string) (*SketchVersion, error) {
+	var found *SketchVersion
+	for i := range h.Versions {
+		if sha != "" && strings.HasPrefix(h.Versions[i].SHA256, strings.ToLower(sha)) {
+			if found != nil {
+				return nil, errors.Errorf("version %s is ambiguous", sha)
+			}
+			found = &h.Versions[i]
+		}
+	}
+	if found == nil {
+		return nil, errors.Errorf("version %s not found", sha)
+	}
+	return found, nil
+}
+
+// archiveSketchVersion keeps a copy of an installed binary in the sketch history.
+// It becomes the active version only once installed for good, see markActiveSketchVersion.
+func archiveSketchVersion(id, name, url, path, sha string, config Config) error {
+	history, folder, err := loadSketchVersions(id)
+	if err != nil {
+		return err
+	}
+
+	archived := filepath.Join(folder, sha)
+	if _, err := os.Stat(archived); os.IsNotExist(err) {
+		// hard link when possible, the binary is on the same filesystem
+		if err := os.Link(path, archived); err != nil {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(archived, data, 0700); err != nil {
+				return err
+			}
+		}
+	}
+	info, err := os.Stat(archived)
+	if err != nil {
+		return err
+	}
+
+	versions := []SketchVersion{{SHA256: sha, Name: name, URL: url, Size: info.Size(), UploadedAt: time.Now()}}
+	for _, v := range history.Versions {
+		if v.SHA256 != sha {
+			versions = append(versions, v)
+		}
+	}
+	history.Versions = versions
+
+	if err := history.prune(folder, config.SketchVersions); err != nil {
+		return err
+	}
+	if err := history.save(folder); err != nil {
+		return err
+	}
+	return enforceSketchQuota(config.SketchQuota, sha)
+}
+
+// prune deletes the oldest versions beyond count, never the active one nor the newest,
+// which is being installed
+func (h *SketchVersions) prune(folder string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	var kept []SketchVersion
+	for i, v := range h.Versions {
+		if len(kept) < count || i == 0 || v.SHA256 == h.Active {
+			kept = append(kept, v)
+			continue
+		}
+		if err := os.Remove(filepath.Join(folder, v.SHA256)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	h.Versions = kept
+	return nil
+}
+
+// enforceSketchQuota deletes the oldest inactive versions of any sketch
+// until the sketch folder fits in quota megabytes. The version being
+// installed, keep, is not deleted.
+func enforceSketchQuota(quota int64, keep string) error {
+	if quota <= 0 {
+		return nil
+	}
+	sketchFolder, err := getSketchFolder()
+	if err != nil {
+		return err
+	}
+	versionsFolder, err := getSketchSubFolder("versions")
+	if err != nil {
+		return err
+	}
+	return pruneToQuota(sketchFolder, versionsFolder, quota, keep)
+}
+
+// pruneToQuota deletes the versions found in versionsFolder as described in enforceSketchQuota
+func pruneToQuota(sketchFolder, versionsFolder string, quota int64, keep string) error {
+	used := folderSize(sketchFolder)
+	if used <= quota*1024*1024 {
+		return nil
+	}
+
+	// collect all the inactive versions, oldest first
+	type candidate struct {
+		history *SketchVersions
+		folder  string
+		version SketchVersion
+	}
+	var candidates []candidate
+	dirs, err := ioutil.ReadDir(versionsFolder)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		folder := filepath.Join(versionsFolder, dir.Name())
+		history := &SketchVersions{}
+		raw, err := ioutil.ReadFile(filepath.Join(folder, "versions.json"))
+		if err != nil || json.Unmarshal(raw, history) != nil {
+			continue
+		}
+		for _, v := range history.Versions {
+			if v.SHA256 != history.Active && v.SHA256 != keep {
+				candidates = append(candidates, candidate{history, folder, v})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].version.UploadedAt.Before(candidates[j].version.UploadedAt)
+	})
+
+	for _, c := range candidates {
+		if used <= quota*1024*1024 {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.folder, c.version.SHA256)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		used -= c.version.Size
+		for i, v := range c.history.Versions {
+			if v.SHA256 == c.version.SHA256 {
+				c.history.Versions = append(c.history.Versions[:i], c.history.Versions[i+1:]...)
+				break
+			}
+		}
+		if err := c.history.save(c.folder); err != nil {
+			return err
+		}
+	}
+	if used > quota*1024*1024 {
+		return errors.Errorf("sketch folder exceeds the quota of %dMB", quota)
+	}
+	return nil
+}
+
+func folderSize(folder string) int64 {
+	var size int64
+	inodes := map[uint64]bool{}
+	filepath.Walk(folder, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return nil
+		}
+		// hard linked versions take space only once
+		if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+			if inodes[uint64(stat.Ino)] {
+				return nil
+			}
+			inodes[uint64(stat.Ino)] = true
+		}
+		size += f.Size()
+		return nil
+	})
+	return size
+}
+
+// markActiveSketchVersion records which binary of the history is running
+func markActiveSketchVersion(id, sha string) error {
+	history, folder, err := loadSketchVersions(id)
+	if err != nil {
+		return err
+	}
+	history.Active = sha
+	return history.save(folder)
+}
+
+// activateSketchVersion stops the sketch and restarts it with an archived binary
+func (status *Status) activateSketchVersion(sketch *SketchStatus, sha string) error {
+	history, folder, err := loadSketchVersions(sketch.ID)
+	if err != nil {
+		return err
+	}
+	version, err := history.find(sha)
+	if err != nil {
+		return err
+	}
+
+	sketchFolder, err := getSketchFolder()
+	if err != nil {
+		return err
+	}
+	stagingFolder, err := getSketchSubFolder("staging")
+	if err != nil {
+		return err
+	}
+
+	// copy the archived binary next to the sketch, so that the swap is atomic
+	data, err := ioutil.ReadFile(filepath.Join(folder, version.SHA256))
+	if err != nil {
+		return errors.Wrapf(err, "read version %s", version.SHA256)
+	}
+	staged := filepath.Join(stagingFolder, version.Name)
+	if err := ioutil.WriteFile(staged, data, 0700); err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+
+	if err := status.stopSketchIfActive(sketch); err != nil {
+		return err
+	}
+	if sketch.Name != version.Name {
+		os.Remove(filepath.Join(sketchFolder, sketch.Name))
+	}
+	if err := os.Rename(staged, filepath.Join(sketchFolder, version.Name)); err != nil {
+		return err
+	}
+
+	sketch.Name = version.Name
+	insertSketchInDB(sketch.Name, sketch.ID)
+	history.Active = version.SHA256
+	if err := history.save(folder); err != nil {
+		return err
+	}
+
+	return applyAction(sketch, "START", status)
+}
+
+// SketchVersionsEvent lists the binaries kept for a sketch
+func (status *Status) SketchVersionsEvent(client mqtt.Client, msg mqtt.Message) {
+	var info struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(msg.Payload(), &info)
+	if err != nil {
+		status.Error("/sketch/versions", errors.Wrapf(err, "unmarshal %s", msg.Payload()))
+		return
+	}
+	if _, ok := status.Sketches[info.ID]; !ok {
+		status.Error("/sketch/versions", errors.New("sketch "+info.ID+" not found"))
+		return
+	}
+
+	history, _, err := loadSketchVersions(info.ID)
+	if err != nil {
+		status.Error("/sketch/versions", errors.Wrapf(err, "load versions of %s", info.ID))
+		return
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		status.Error("/sketch/versions", errors.Wrap(err, "json marshal result"))
+		return
+	}
+	status.Info("/sketch/versions", string(data)+"\n")
+}
@@ -0,0 +1,265 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketchVersionsFolderName(t *testing.T) {
+	// ids that used to share a folder
+	ids := []string{"a/b", "a_b", "a b", "a\\b", "..", "", "4c1f3a9d-ed78-4ae4-94c8-bcfa2e94c692"}
+	names := map[string]string{}
+	for _, id := range ids {
+		name := sketchVersionsFolderName(id)
+		assert.True(t, plainFileName(name), id)
+		assert.Len(t, name, 64, id)
+		assert.Equal(t, name, sketchVersionsFolderName(id), id)
+		if other, ok := names[name]; ok {
+			t.Errorf("%q and %q share the folder %s", id, other, name)
+		}
+		names[name] = id
+	}
+}
+
+func TestSketchVersionFind(t *testing.T) {
+	history := &SketchVersions{Versions: []SketchVersion{
+		{SHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		{SHA256: "9f86aaaa884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		{SHA256: "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"},
+	}}
+	tests := []struct {
+		sha   string
+		found string
+		err   string
+	}{
+		{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", ""},
+		{"9f86d0", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", ""},
+		{"9F86D0", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", ""},
+		{"6030", "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752", ""},
+		{"9f86", "", "ambiguous"},
+		{"ffff", "", "not found"},
+		{"", "", "not found"},
+	}
+	for _, test := range tests {
+		version, err := history.find(test.sha)
+		if test.err == "" {
+			if assert.NoError(t, err, test.sha) {
+				assert.Equal(t, test.found, version.SHA256, test.sha)
+			}
+		} else if assert.Error(t, err, test.sha) {
+			assert.Contains(t, err.Error(), test.err, test.sha)
+		}
+	}
+}
+
+func TestSketchVersionsPrune(t *testing.T) {
+	folder, err := ioutil.TempDir("", "versions")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+
+	tests := []struct {
+		name   string
+		count  int
+		active string
+		kept   []string
+	}{
+		{"no limit", 0, "c", []string{"a", "b", "c", "d"}},
+		{"oldest removed", 2, "a", []string{"a", "b"}},
+		{"active kept", 2, "d", []string{"a", "b", "d"}},
+		{"new one kept", 1, "c", []string{"a", "c"}},
+	}
+	for _, test := range tests {
+		history := &SketchVersions{Active: test.active}
+		for _, sha := range []string{"a", "b", "c", "d"} {
+			ioutil.WriteFile(filepath.Join(folder, sha), []byte(sha), 0600)
+			history.Versions = append(history.Versions, SketchVersion{SHA256: sha})
+		}
+		assert.NoError(t, history.prune(folder, test.count), test.name)
+		var kept []string
+		for _, v := range history.Versions {
+			kept = append(kept, v.SHA256)
+			_, err := os.Stat(filepath.Join(folder, v.SHA256))
+			assert.NoError(t, err, test.name)
+		}
+		assert.Equal(t, test.kept, kept, test.name)
+	}
+}
+
+func TestPruneToQuota(t *testing.T) {
+	// a bit less than 1MB, the histories take some space too
+	const size = 1024*1024 - 1024
+	tests := []struct {
+		name  string
+		quota int64
+		keep  string
+		kept  map[string][]string
+		err   string
+	}{
+		{"within quota", 5, "", map[string][]string{"blink": {"b1", "b2", "b3"}, "fade": {"f1", "f2"}}, ""},
+		{"oldest inactive first", 4, "", map[string][]string{"blink": {"b1", "b3"}, "fade": {"f1", "f2"}}, ""},
+		{"next oldest", 3, "", map[string][]string{"blink": {"b1"}, "fade": {"f1", "f2"}}, ""},
+		{"across sketches", 2, "", map[string][]string{"blink": {"b1"}, "fade": {"f1"}}, ""},
+		{"version being installed", 3, "b3", map[string][]string{"blink": {"b1", "b3"}, "fade": {"f1"}}, ""},
+		{"active versions kept", 1, "", map[string][]string{"blink": {"b1"}, "fade": {"f1"}}, "exceeds the quota"},
+	}
+	for _, test := range tests {
+		folder, err := ioutil.TempDir("", "quota")
+		if !assert.NoError(t, err) {
+			return
+		}
+		versionsFolder := filepath.Join(folder, "versions")
+		os.Mkdir(versionsFolder, 0700)
+
+		// b2 is the oldest inactive version, then b3, then f2
+		now := time.Now()
+		histories := map[string]*SketchVersions{
+			"blink": {ID: "blink", Active: "b1", Versions: []SketchVersion{
+				{SHA256: "b3", Size: size, UploadedAt: now.Add(-2 * time.Hour)},
+				{SHA256: "b2", Size: size, UploadedAt: now.Add(-3 * time.Hour)},
+				{SHA256: "b1", Size: size, UploadedAt: now.Add(-4 * time.Hour)},
+			}},
+			"fade": {ID: "fade", Active: "f1", Versions: []SketchVersion{
+				{SHA256: "f2", Size: size, UploadedAt: now.Add(-time.Hour)},
+				{SHA256: "f1", Size: size, UploadedAt: now.Add(-5 * time.Hour)},
+			}},
+		}
+		for id, history := range histories {
+			historyFolder := filepath.Join(versionsFolder, sketchVersionsFolderName(id))
+			os.Mkdir(historyFolder, 0700)
+			for _, v := range history.Versions {
+				ioutil.WriteFile(filepath.Join(historyFolder, v.SHA256), make([]byte, size), 0600)
+			}
+			history.save(historyFolder)
+		}
+
+		err = pruneToQuota(folder, versionsFolder, test.quota, test.keep)
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+		for id, kept := range test.kept {
+			historyFolder := filepath.Join(versionsFolder, sketchVersionsFolderName(id))
+			history := &SketchVersions{}
+			raw, _ := ioutil.ReadFile(filepath.Join(historyFolder, "versions.json"))
+			json.Unmarshal(raw, history)
+			var versions []string
+			for _, v := range history.Versions {
+				versions = append(versions, v.SHA256)
+			}
+			files, _ := filepath.Glob(filepath.Join(historyFolder, "[bf]*"))
+			for i := range files {
+				files[i] = filepath.Base(files[i])
+			}
+			assert.ElementsMatch(t, kept, versions, test.name+" "+id)
+			assert.ElementsMatch(t, kept, files, test.name+" "+id)
+		}
+		os.RemoveAll(folder)
+	}
+}
+
+func TestSketchVersionActivation(t *testing.T) {
+	folder, err := ioutil.TempDir("", "versions")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+
+	id := "versions-test-" + filepath.Base(folder)
+	versionsFolder, err := getSketchVersionsFolder(id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(versionsFolder)
+
+	archive := func(content string) string {
+		path := filepath.Join(folder, "blink")
+		ioutil.WriteFile(path, []byte(content), 0700)
+		sum := sha256.Sum256([]byte(content))
+		sha := hex.EncodeToString(sum[:])
+		assert.NoError(t, archiveSketchVersion(id, "blink", "", path, sha, Config{}))
+		return sha
+	}
+	active := func() string {
+		history, _, err := loadSketchVersions(id)
+		assert.NoError(t, err)
+		return history.Active
+	}
+
+	first := archive("first")
+	assert.Empty(t, active())
+	assert.NoError(t, markActiveSketchVersion(id, first))
+
+	// the new version is active only at the end of its probation
+	second := archive("second")
+	assert.Equal(t, first, active())
+	backup := filepath.Join(folder, "backup")
+	ioutil.WriteFile(backup, []byte("first"), 0700)
+	sketch := &SketchStatus{ID: id, probation: &sketchProbation{name: "blink", path: backup, version: second}}
+	sketch.endProbation()
+	assert.Equal(t, second, active())
+	assert.Nil(t, sketch.probation)
+	_, err = os.Stat(backup)
+	assert.True(t, os.IsNotExist(err))
+
+	// both versions are kept for a rollback
+	history, _, _ := loadSketchVersions(id)
+	if assert.Len(t, history.Versions, 2) {
+		assert.Equal(t, second, history.Versions[0].SHA256)
+		assert.Equal(t, first, history.Versions[1].SHA256)
+	}
+}
+
+func TestSketchVersionsLegacyFolder(t *testing.T) {
+	versionsFolder, err := getSketchSubFolder("versions")
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := "legacy/test"
+	legacy := filepath.Join(versionsFolder, "legacy_test")
+	os.Mkdir(legacy, 0700)
+	defer os.RemoveAll(legacy)
+	(&SketchVersions{ID: id, Active: "a"}).save(legacy)
+
+	// another sketch that used to share the folder doesn't get its history
+	folder, err := getSketchVersionsFolder("legacy_test")
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, legacy, folder)
+		os.RemoveAll(folder)
+	}
+
+	history, folder, err := loadSketchVersions(id)
+	if assert.NoError(t, err) {
+		defer os.RemoveAll(folder)
+		assert.Equal(t, filepath.Join(versionsFolder, sketchVersionsFolderName(id)), folder)
+		assert.Equal(t, "a", history.Active)
+	}
+}
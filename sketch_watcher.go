@@ -0,0 +1,309 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const (
+	// a file is considered completely written when its size and modification
+	// time don't change for this long
+	fileSettleTime = 2 * time.Second
+	// how often mounted filesystems are checked for new removable drives
+	mountPollInterval = 3 * time.Second
+)
+
+// LocalSketchManifest can accompany a sketch copied in the drop folder or on a
+// removable drive, as <sketch file>.json or <sketch name>.json
+type LocalSketchManifest struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// sketchNameFromFile strips the extensions of a sketch file name
+func sketchNameFromFile(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".tar.gz", ".tgz", ".bin", ".elf"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	return unsafeNameChars.ReplaceAllString(name, "_")
+}
+
+// isSketchCompanion tells if the file is a manifest or a signature of a sketch
+func isSketchCompanion(path string) bool {
+	return strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".sig") || strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// readLocalSketchManifest reads the manifest and the detached signature accompanying a sketch file
+func readLocalSketchManifest(path string) LocalSketchManifest {
+	var manifest LocalSketchManifest
+	stem := filepath.Join(filepath.Dir(path), sketchNameFromFile(path))
+	for _, candidate := range []string{path + ".json", stem + ".json"} {
+		if data, err := ioutil.ReadFile(candidate); err == nil {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				log.Println("Ignoring invalid manifest " + candidate + ": " + err.Error())
+			}
+			break
+		}
+	}
+	if manifest.Signature == "" {
+		if sig, err := ioutil.ReadFile(path + ".sig"); err == nil {
+			manifest.Signature = base64.StdEncoding.EncodeToString(sig)
+		}
+	}
+	if manifest.Name == "" {
+		manifest.Name = sketchNameFromFile(path)
+	}
+	manifest.Name = unsafeNameChars.ReplaceAllString(filepath.Base(manifest.Name), "_")
+	if manifest.ID == "" {
+		manifest.ID = manifest.Name
+	}
+	return manifest
+}
+
+// waitUntilWritten returns when the file stopped growing, or an error if it disappeared
+func waitUntilWritten(path string) error {
+	var last os.FileInfo
+	stableSince := time.Now()
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if last == nil || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()) {
+			last = info
+			stableSince = time.Now()
+		} else if time.Since(stableSince) >= fileSettleTime {
+			return nil
+		}
+		time.Sleep(fileSettleTime / 4)
+	}
+}
+
+// installLocalSketch installs and starts a sketch found on the filesystem.
+// The sketches of the drop folder are removed once installed, the ones of a
+// removable drive are left there but they always need a valid signature:
+// anybody can plug a drive in.
+func (status *Status) installLocalSketch(path string, fromRemovableDrive bool) error {
+	manifest := readLocalSketchManifest(path)
+
+	// work on a copy, the original may be on a removable drive
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile("", "sketch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	config := status.config
+	config.RequireSignedSketches = config.RequireSignedSketches || config.RequireSignedLocalSketches || fromRemovableDrive
+	err = verifySketch(tmpFile.Name(), manifest.SHA256, manifest.Signature, config)
+	if err != nil {
+		return errors.Wrapf(err, "verify sketch %s", path)
+	}
+
+	if !fromRemovableDrive {
+		os.Remove(path)
+		os.Remove(path + ".json")
+		os.Remove(path + ".sig")
+	}
+
+	// don't restart a sketch if it's already running this binary
+	if sha, err := fileSHA256(tmpFile.Name()); err == nil {
+		if history, _, err := loadSketchVersions(manifest.ID); err == nil && history.Active == sha {
+			if sketch, ok := status.Sketches[manifest.ID]; ok {
+				sketch.mutex.Lock()
+				running := sketch.Status == SketchRunning
+				sketch.mutex.Unlock()
+				if running {
+					log.Println("Sketch " + manifest.ID + " is already up to date")
+					return nil
+				}
+			}
+		}
+	}
+
+	log.Println("Installing local sketch " + path + " as " + manifest.ID)
+	status.installSketch(manifest.ID, manifest.Name, "file://"+path, tmpFile.Name())
+	return nil
+}
+
+// addWatcherForManuallyAddedSketches installs the sketches copied in folderOrigin,
+// once they're completely written
+func addWatcherForManuallyAddedSketches(folderOrigin string, status *Status) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("Can't watch " + folderOrigin + ": " + err.Error())
+		return
+	}
+	defer watcher.Close()
+
+	// files being written, they're processed only once
+	var pendingMutex sync.Mutex
+	pending := map[string]bool{}
+
+	process := func(path string) {
+		defer func() {
+			pendingMutex.Lock()
+			delete(pending, path)
+			pendingMutex.Unlock()
+		}()
+		if err := waitUntilWritten(path); err != nil {
+			return
+		}
+		if err := status.installLocalSketch(path, true); err != nil {
+			log.Println("Got error:" + err.Error())
+			status.Error("/upload", err)
+		}
+	}
+
+	// pick up the sketches copied while the connector wasn't running
+	files, _ := ioutil.ReadDir(folderOrigin)
+	for _, file := range files {
+		path := filepath.Join(folderOrigin, file.Name())
+		if file.Mode().IsRegular() && !isSketchCompanion(path) {
+			pendingMutex.Lock()
+			pending[path] = true
+			pendingMutex.Unlock()
+			go process(path)
+		}
+	}
+
+	err = watcher.Add(folderOrigin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		select {
+		case event := <-watcher.Events:
+			log.Println("event:", event)
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 || isSketchCompanion(event.Name) {
+				continue
+			}
+			pendingMutex.Lock()
+			if !pending[event.Name] {
+				pending[event.Name] = true
+				go process(event.Name)
+			}
+			pendingMutex.Unlock()
+		case err := <-watcher.Errors:
+			log.Println("error:", err)
+		}
+	}
+}
+
+// removableMounts returns the mount points of the removable drives
+func removableMounts() map[string]bool {
+	mounts := map[string]bool{}
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return mounts
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		// mount points are escaped in /proc/mounts
+		mountPoint := strings.Replace(fields[1], "\\040", " ", -1)
+		if isRemovableDevice(fields[0]) {
+			mounts[mountPoint] = true
+		}
+	}
+	return mounts
+}
+
+// isRemovableDevice checks the removable flag of the disk, or of the disk containing the partition
+func isRemovableDevice(device string) bool {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false
+	}
+	block := filepath.Join("/sys/class/block", filepath.Base(device))
+	for _, flag := range []string{filepath.Join(block, "removable"), filepath.Join(block, "..", "removable")} {
+		if data, err := ioutil.ReadFile(flag); err == nil {
+			return strings.TrimSpace(string(data)) == "1"
+		}
+	}
+	return false
+}
+
+// watchRemovableDrives installs the sketches found in the folder named
+// sketchDir of every removable drive mounted
+func watchRemovableDrives(sketchDir string, status *Status) {
+	known := removableMounts()
+	for {
+		time.Sleep(mountPollInterval)
+		current := removableMounts()
+		for mountPoint := range current {
+			if known[mountPoint] {
+				continue
+			}
+			folder := filepath.Join(mountPoint, sketchDir)
+			files, err := ioutil.ReadDir(folder)
+			if err != nil {
+				continue
+			}
+			log.Println("Found sketches on removable drive " + mountPoint)
+			for _, file := range files {
+				path := filepath.Join(folder, file.Name())
+				if !file.Mode().IsRegular() || isSketchCompanion(path) {
+					continue
+				}
+				if err := status.installLocalSketch(path, true); err != nil {
+					log.Println("Got error:" + err.Error())
+					status.Error("/upload", err)
+				}
+			}
+		}
+		known = current
+	}
+}
@@ -0,0 +1,146 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestWaitUntilWritten(t *testing.T) {
+	folder, err := ioutil.TempDir("", "watcher")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+
+	path := filepath.Join(folder, "blink.bin")
+	assert.Error(t, waitUntilWritten(path))
+
+	// the file is still being copied for a while
+	ioutil.WriteFile(path, []byte("part"), 0600)
+	start := time.Now()
+	go func() {
+		time.Sleep(fileSettleTime / 2)
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err == nil {
+			file.Write([]byte(" and the rest"))
+			file.Close()
+		}
+	}()
+	assert.NoError(t, waitUntilWritten(path))
+	assert.True(t, time.Since(start) >= fileSettleTime/2+fileSettleTime, "returned after %s", time.Since(start))
+	data, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "part and the rest", string(data))
+
+	// a file removed while waiting is not installed
+	go func() {
+		time.Sleep(fileSettleTime / 2)
+		os.Remove(path)
+	}()
+	assert.Error(t, waitUntilWritten(path))
+}
+
+func TestInstallLocalSketchSignature(t *testing.T) {
+	folder, err := ioutil.TempDir("", "watcher")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+
+	sketch := []byte("sketch binary")
+	sum := sha256.Sum256(sketch)
+	sha := hex.EncodeToString(sum[:])
+	signer, keyring := testSigner(t, folder, "trusted")
+	other, _ := testSigner(t, folder, "other")
+	sign := func(signer *openpgp.Entity) []byte {
+		var sig bytes.Buffer
+		if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(sketch), nil); err != nil {
+			t.Fatal(err)
+		}
+		return sig.Bytes()
+	}
+
+	tests := []struct {
+		name      string
+		removable bool
+		config    Config
+		manifest  string
+		signature []byte
+		err       string
+	}{
+		{"unsigned from a drive", true, Config{SketchKeyring: keyring}, "", nil, "only accepts signed sketches"},
+		{"unknown key from a drive", true, Config{SketchKeyring: keyring}, "", sign(other), "wrong signature"},
+		{"sha256 mismatch from a drive", true, Config{SketchKeyring: keyring}, `{"sha256": "` + hex.EncodeToString(make([]byte, 32)) + `"}`, sign(signer), "sha256 mismatch"},
+		{"unsigned from the drop folder", false, Config{SketchKeyring: keyring, RequireSignedLocalSketches: true}, "", nil, "only accepts signed sketches"},
+		{"unknown key from the drop folder", false, Config{SketchKeyring: keyring}, "", sign(other), "wrong signature"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(folder, "blink.bin")
+		os.Remove(path + ".json")
+		os.Remove(path + ".sig")
+		ioutil.WriteFile(path, sketch, 0600)
+		if test.manifest != "" {
+			ioutil.WriteFile(path+".json", []byte(test.manifest), 0600)
+		}
+		if test.signature != nil {
+			ioutil.WriteFile(path+".sig", test.signature, 0600)
+		}
+
+		status := NewStatus("dev", nil, nil)
+		status.config = test.config
+		err := status.installLocalSketch(path, test.removable)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+		// a refused sketch is left where it was
+		_, err = os.Stat(path)
+		assert.NoError(t, err, test.name)
+	}
+
+	// a signed sketch from a drive that is already running isn't installed again
+	id := "watcher-test-" + hex.EncodeToString(sum[:4])
+	history, versionsFolder, err := loadSketchVersions(id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(versionsFolder)
+	history.Active = sha
+	assert.NoError(t, history.save(versionsFolder))
+
+	path := filepath.Join(folder, "blink.bin")
+	ioutil.WriteFile(path, sketch, 0600)
+	ioutil.WriteFile(path+".json", []byte(`{"id": "`+id+`"}`), 0600)
+	ioutil.WriteFile(path+".sig", sign(signer), 0600)
+	status := NewStatus("dev", nil, nil)
+	status.config = Config{SketchKeyring: keyring}
+	status.Sketches[id] = &SketchStatus{ID: id, Name: "blink", Status: SketchRunning}
+	assert.NoError(t, status.installLocalSketch(path, true))
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
@@ -23,21 +23,38 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	docker "github.com/docker/docker/client"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nats "github.com/nats-io/go-nats"
 	"github.com/pkg/errors"
 )
 
 // Status contains info about the sketches running on the device
 type Status struct {
 	id             string
+	config         Config
 	mqttClient     mqtt.Client
 	dockerClient   docker.APIClient
+	natsClient     *nats.Conn
+	nats           *natsServer
+	mqttBroker     *mqttBroker
+	bridge         *bridge
 	Sketches       map[string]*SketchStatus `json:"sketches"`
+	Shadow         *shadowSync              `json:"shadow"`
 	messagesSent   int
 	firstMessageAt time.Time
+	uploads        map[string]*chunkedUpload
+	uploadsMutex   sync.Mutex
+	shells         map[string]*shellSession
+	shellsMutex    sync.Mutex
+	serialPorts    map[string]*serialPort
+	serialMutex    sync.Mutex
+	// sketchTokens maps the ids of the sketches, as subject tokens, to the ids
+	sketchTokens map[string]string
+	tokensMutex  sync.Mutex
 }
 
 // SketchBinding represents a pair (SketchName,SketchId)
@@ -51,9 +68,25 @@ type SketchStatus struct {
 	Name      string     `json:"name"`
 	ID        string     `json:"id"`
 	PID       int        `json:"pid"`
-	Status    string     `json:"status"` // could be bool if we don't allow Pause
+	Status    string     `json:"status"` // one of the Sketch* states
 	Endpoints []Endpoint `json:"endpoints"`
-	pty       *os.File
+	// FailedVersion is the sha256 of the last upload that was rolled back
+	FailedVersion string `json:"failed_version,omitempty"`
+	// Display is the graphical session the sketch is started in
+	Display         *DisplaySettings `json:"display,omitempty"`
+	displayReported bool
+	pty             *os.File
+	probation       *sketchProbation
+	// process is the running process of the sketch, done is closed when it exits
+	process *os.Process
+	// group is the process group of a sketch running on the host
+	group *processGroup
+	done  chan struct{}
+	mutex sync.Mutex
+	// container is the id of the container running the sketch, if any
+	container string
+	// telemetry extracts properties from the output of the sketch, guarded by mutex
+	telemetry *telemetryParser
 }
 
 // Endpoint is an exposed function
@@ -69,6 +102,11 @@ func NewStatus(id string, mqttClient mqtt.Client, dockerClient docker.APIClient)
 		mqttClient:   mqttClient,
 		dockerClient: dockerClient,
 		Sketches:     map[string]*SketchStatus{},
+		uploads:      map[string]*chunkedUpload{},
+		shells:       map[string]*shellSession{},
+		serialPorts:  map[string]*serialPort{},
+		sketchTokens: map[string]string{},
+		Shadow:       newShadowSync(),
 	}
 }
 
@@ -152,6 +190,19 @@ func (s *Status) Raw(topic, msg string) {
 	}
 }
 
+// Stream sends a message of an output that has its own rate limit, like a serial port
+// or a shell session: it doesn't count in (nor wait for) the throttling of Raw
+func (s *Status) Stream(topic, msg string) {
+	if s.mqttClient == nil {
+		return
+	}
+	token := s.mqttClient.Publish("$aws/things/"+s.id+topic, 1, false, msg)
+	token.Wait()
+	if debugMqtt {
+		fmt.Println("MQTT OUT: $aws/things/"+s.id+topic, msg)
+	}
+}
+
 // InfoCommandOutput sends command output on the specified topic
 func (s *Status) InfoCommandOutput(topic string, out []byte) {
 	// Prepare response payload
@@ -171,7 +222,7 @@ func (s *Status) InfoCommandOutput(topic string, out []byte) {
 
 // Publish sens on the /status topic a json representation of the connector
 func (s *Status) Publish() {
-	data, err := json.Marshal(s)
+	data, err := s.JSON()
 
 	//var out bytes.Buffer
 	//json.Indent(&out, data, "", "  ")
@@ -184,3 +235,8 @@ func (s *Status) Publish() {
 
 	s.Info("/status", string(data)+"\n")
 }
+
+// JSON returns the representation of the connector sent on /status
+func (s *Status) JSON() ([]byte, error) {
+	return json.Marshal(s)
+}
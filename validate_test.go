@@ -0,0 +1,167 @@
+//
+//  This file is part of arduino-connector
+//
+//  Copyright (C) 2017-2018  Arduino AG (http://www.arduino.cc/)
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// testSigner returns a new key, and a keyring with its public part written in folder
+func testSigner(t *testing.T, folder, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the self signatures are made while serializing the private key
+	if err := entity.SerializePrivate(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	var keyring bytes.Buffer
+	if err := entity.Serialize(&keyring); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(folder, name+".gpg")
+	if err := ioutil.WriteFile(path, keyring.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return entity, path
+}
+
+func TestVerifySketch(t *testing.T) {
+	folder, err := ioutil.TempDir("", "validate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+
+	sketch := []byte("sketch binary")
+	fileName := filepath.Join(folder, "sketch")
+	ioutil.WriteFile(fileName, sketch, 0600)
+	sum := sha256.Sum256(sketch)
+	sha := hex.EncodeToString(sum[:])
+
+	signer, keyring := testSigner(t, folder, "trusted")
+	other, _ := testSigner(t, folder, "other")
+	sign := func(signer *openpgp.Entity, data []byte) string {
+		var sig bytes.Buffer
+		if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(data), nil); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(sig.Bytes())
+	}
+
+	optional := Config{SketchKeyring: keyring}
+	required := Config{SketchKeyring: keyring, RequireSignedSketches: true}
+	tests := []struct {
+		name      string
+		sha256    string
+		signature string
+		config    Config
+		err       string
+	}{
+		{"nothing to check", "", "", optional, ""},
+		{"sha256", sha, "", optional, ""},
+		{"sha256 upper case", string(bytes.ToUpper([]byte(sha))), "", optional, ""},
+		{"sha256 mismatch", hex.EncodeToString(make([]byte, 32)), "", optional, "sha256 mismatch"},
+		{"missing signature", sha, "", required, "only accepts signed sketches"},
+		{"valid signature", sha, sign(signer, sketch), required, ""},
+		{"valid signature not required", "", sign(signer, sketch), optional, ""},
+		{"signature of another file", sha, sign(signer, []byte("another binary")), required, "wrong signature"},
+		{"signature of an unknown key", sha, sign(other, sketch), required, "wrong signature"},
+		{"signature not in base64", sha, "not base64!", required, "decode signature"},
+		{"garbage signature", sha, base64.StdEncoding.EncodeToString([]byte("garbage")), required, "wrong signature"},
+		{"bad signature not required", "", sign(other, sketch), optional, "wrong signature"},
+	}
+	for _, test := range tests {
+		err := verifySketch(fileName, test.sha256, test.signature, test.config)
+		if test.err == "" {
+			assert.NoError(t, err, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err, test.name)
+		}
+	}
+
+	// the default keyring is the Arduino key
+	err = verifySketch(fileName, sha, sign(signer, sketch), Config{RequireSignedSketches: true})
+	assert.Error(t, err)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	folder, err := ioutil.TempDir("", "validate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(folder)
+	signer, binary := testSigner(t, folder, "trusted")
+
+	var armored bytes.Buffer
+	writer, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	signer.Serialize(writer)
+	writer.Close()
+	armoredPath := filepath.Join(folder, "trusted.asc")
+	ioutil.WriteFile(armoredPath, armored.Bytes(), 0600)
+
+	tests := []struct {
+		name    string
+		keyring string
+		keys    int
+		err     bool
+	}{
+		{"arduino key", "", 1, false},
+		{"binary keyring", binary, 1, false},
+		{"armored keyring", armoredPath, 1, false},
+		{"missing keyring", filepath.Join(folder, "missing.gpg"), 0, true},
+	}
+	for _, test := range tests {
+		keyring, err := loadKeyring(test.keyring)
+		if test.err {
+			assert.Error(t, err, test.name)
+			continue
+		}
+		if assert.NoError(t, err, test.name) {
+			assert.Len(t, keyring, test.keys, test.name)
+		}
+	}
+
+	// armored signatures are accepted too
+	fileName := filepath.Join(folder, "sketch")
+	ioutil.WriteFile(fileName, []byte("sketch binary"), 0600)
+	file, _ := os.Open(fileName)
+	var sig bytes.Buffer
+	openpgp.ArmoredDetachSign(&sig, signer, file, nil)
+	file.Close()
+	sigFile := filepath.Join(folder, "sketch.asc")
+	ioutil.WriteFile(sigFile, sig.Bytes(), 0600)
+	assert.NoError(t, checkGPGSigWithKeyring(fileName, sigFile, armoredPath))
+	assert.Error(t, checkGPGSig(fileName, sigFile))
+}